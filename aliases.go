@@ -0,0 +1,158 @@
+package xcore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The visibilities of a frame in the public frame directory.
+const (
+	DirectoryVisibilityPublic  = "public"
+	DirectoryVisibilityPrivate = "private"
+)
+
+// CanonicalAliasContent is the content of an m.frame.canonical_alias event.
+type CanonicalAliasContent struct {
+	Alias      string   `json:"alias,omitempty"`
+	AltAliases []string `json:"alt_aliases,omitempty"`
+}
+
+// isValidAlias returns true if the alias has the form #localpart:server.
+func isValidAlias(alias string) bool {
+	return len(alias) <= 255 && strings.HasPrefix(alias, "#") && strings.Index(alias, ":") > 1 && !strings.HasSuffix(alias, ":")
+}
+
+// AddAltAlias adds the alias to AltAliases, unless it is already the canonical alias or an alternative.
+func (c *CanonicalAliasContent) AddAltAlias(alias string) {
+	if alias == c.Alias || containsString(c.AltAliases, alias) {
+		return
+	}
+	c.AltAliases = append(c.AltAliases, alias)
+}
+
+// RemoveAlias removes the alias from the canonical alias and AltAliases.
+func (c *CanonicalAliasContent) RemoveAlias(alias string) {
+	if c.Alias == alias {
+		c.Alias = ""
+	}
+	var altAliases []string // not filtered in place, as the caller may share the backing array
+	for _, alt := range c.AltAliases {
+		if alt != alias {
+			altAliases = append(altAliases, alt)
+		}
+	}
+	c.AltAliases = altAliases
+}
+
+// Aliases returns the canonical alias, if any, followed by the alternative aliases.
+func (c *CanonicalAliasContent) Aliases() []string {
+	var aliases []string
+	if c.Alias != "" {
+		aliases = append(aliases, c.Alias)
+	}
+	return append(aliases, c.AltAliases...)
+}
+
+// CanonicalAlias returns the content of the m.frame.canonical_alias event. The content is empty if there is none.
+func (s *FrameState) CanonicalAlias() *CanonicalAliasContent {
+	content := &CanonicalAliasContent{}
+	if event := s.GetStateEvent("m.frame.canonical_alias", ""); event != nil {
+		if err := event.ParseContent(content); err != nil {
+			content = &CanonicalAliasContent{}
+		}
+	}
+	return content
+}
+
+// CanonicalAlias returns the content of the frame's current m.frame.canonical_alias event.
+func (frame *Frame) CanonicalAlias() *CanonicalAliasContent {
+	return frame.Snapshot().CanonicalAlias()
+}
+
+// CreateAlias maps the alias to the given frame. See put-coddy-client-r0-directory-frame-framealias
+func (cli *Client) CreateAlias(alias, frameID string) (err error) {
+	urlPath := cli.BuildURL("directory", "frame", alias)
+	err = cli.MakeRequest("PUT", urlPath, &ReqAliasCreate{FrameID: frameID}, nil)
+	return
+}
+
+// DeleteAlias removes the mapping of the alias to a frame. See delete-coddy-client-r0-directory-frame-framealias
+func (cli *Client) DeleteAlias(alias string) (err error) {
+	urlPath := cli.BuildURL("directory", "frame", alias)
+	err = cli.MakeRequest("DELETE", urlPath, nil, nil)
+	return
+}
+
+// ResolveAlias returns the frame the alias maps to and servers which can be used to join it.
+// See get-coddy-client-r0-directory-frame-framealias
+func (cli *Client) ResolveAlias(alias string) (resp *RespAliasResolve, err error) {
+	urlPath := cli.BuildURL("directory", "frame", alias)
+	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// LocalAliases returns the aliases of the frame which were created on the homeserver.
+// See get-coddy-client-r0-frames-frameid-aliases
+func (cli *Client) LocalAliases(frameID string) (resp *RespAliasList, err error) {
+	urlPath := cli.BuildURL("frames", frameID, "aliases")
+	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// FrameDirectoryVisibility returns whether the frame is listed in the public frame directory.
+// See get-coddy-client-r0-directory-list-frame-frameid
+func (cli *Client) FrameDirectoryVisibility(frameID string) (resp *RespFrameDirectoryVisibility, err error) {
+	urlPath := cli.BuildURL("directory", "list", "frame", frameID)
+	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// SetFrameDirectoryVisibility sets whether the frame is listed in the public frame directory. visibility is
+// DirectoryVisibilityPublic or DirectoryVisibilityPrivate. See put-coddy-client-r0-directory-list-frame-frameid
+func (cli *Client) SetFrameDirectoryVisibility(frameID, visibility string) (err error) {
+	if visibility != DirectoryVisibilityPublic && visibility != DirectoryVisibilityPrivate {
+		return fmt.Errorf("invalid directory visibility %q", visibility)
+	}
+	urlPath := cli.BuildURL("directory", "list", "frame", frameID)
+	err = cli.MakeRequest("PUT", urlPath, &ReqFrameDirectoryVisibility{Visibility: visibility}, nil)
+	return
+}
+
+// ValidateCanonicalAlias checks that the aliases in the content are valid and map to the given frame, as the
+// homeserver requires when the m.frame.canonical_alias event is sent. Returns an EventValidationError if not.
+func (cli *Client) ValidateCanonicalAlias(frameID string, content *CanonicalAliasContent) error {
+	fail := func(field, message string) error {
+		return EventValidationError{EventType: "m.frame.canonical_alias", Field: field, Message: message}
+	}
+	seen := make(map[string]bool)
+	for i, alias := range content.Aliases() {
+		field := "alias"
+		if content.Alias == "" || i > 0 {
+			field = "alt_aliases"
+		}
+		if !isValidAlias(alias) {
+			return fail(field, strconv.Quote(alias)+" is not a frame alias")
+		}
+		if seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		resp, err := cli.ResolveAlias(alias)
+		if err != nil {
+			return fail(field, fmt.Sprintf("%q could not be resolved: %s", alias, err))
+		}
+		if resp.FrameID != frameID {
+			return fail(field, fmt.Sprintf("%q points to %s, not %s", alias, resp.FrameID, frameID))
+		}
+	}
+	return nil
+}
+
+// SetCanonicalAlias checks the aliases with ValidateCanonicalAlias, then sends the m.frame.canonical_alias event.
+func (cli *Client) SetCanonicalAlias(frameID string, content *CanonicalAliasContent) (*RespSendEvent, error) {
+	if err := cli.ValidateCanonicalAlias(frameID, content); err != nil {
+		return nil, err
+	}
+	return cli.SendStateEvent(frameID, "m.frame.canonical_alias", "", content)
+}
@@ -0,0 +1,582 @@
+package xcore
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// StateKeyTuple identifies a piece of frame state by its event type and state key.
+type StateKeyTuple struct {
+	EventType string
+	StateKey  string
+}
+
+// AuthEvents are the state events used to authorise an event, keyed by type and state key.
+type AuthEvents map[StateKeyTuple]*PDU
+
+// Get returns the event with the given type and state key, or nil.
+func (a AuthEvents) Get(eventType, stateKey string) *PDU {
+	return a[StateKeyTuple{eventType, stateKey}]
+}
+
+// Add adds the state event to the auth events, replacing any event with the same type and state key.
+// Events without a state key are ignored.
+func (a AuthEvents) Add(event *PDU) {
+	if event.StateKey != nil {
+		a[StateKeyTuple{event.Type, *event.StateKey}] = event
+	}
+}
+
+// Membership returns the membership of the user according to the auth events, or "leave" if there is none.
+func (a AuthEvents) Membership(userID string) string {
+	if member := a.Get("m.frame.member", userID); member != nil {
+		if membership, ok := member.Content["membership"].(string); ok {
+			return membership
+		}
+	}
+	return MembershipLeave
+}
+
+// PowerLevels returns the power levels given by the m.frame.power_levels and m.frame.create auth events.
+func (a AuthEvents) PowerLevels() (*PowerLevels, error) {
+	return NewPowerLevels(pduEvent(a.Get("m.frame.power_levels", "")), pduEvent(a.Get("m.frame.create", "")))
+}
+
+// pduEvent returns the fields of the PDU needed to parse its content as a client event, or nil if pdu is nil.
+func pduEvent(pdu *PDU) *Event {
+	if pdu == nil {
+		return nil
+	}
+	return &Event{
+		ID:        pdu.EventID,
+		Type:      pdu.Type,
+		StateKey:  pdu.StateKey,
+		Sender:    pdu.Sender,
+		Timestamp: pdu.OriginServerTS,
+		Content:   pdu.Content,
+	}
+}
+
+// AuthTypes returns the type and state keys of the state events needed to authorise the event.
+func AuthTypes(event *PDU) []StateKeyTuple {
+	if event.Type == "m.frame.create" && event.StateKey != nil && *event.StateKey == "" {
+		return nil
+	}
+	types := []StateKeyTuple{
+		{"m.frame.create", ""},
+		{"m.frame.power_levels", ""},
+		{"m.frame.member", event.Sender},
+	}
+	if event.Type != "m.frame.member" || event.StateKey == nil {
+		return types
+	}
+	if *event.StateKey != event.Sender {
+		types = append(types, StateKeyTuple{"m.frame.member", *event.StateKey})
+	}
+	switch membership, _ := event.Content["membership"].(string); membership {
+	case MembershipJoin, MembershipInvite, MembershipKnock:
+		types = append(types, StateKeyTuple{"m.frame.join_rules", ""})
+	}
+	if invite, ok := event.Content["third_party_invite"].(map[string]interface{}); ok {
+		if signed, ok := invite["signed"].(map[string]interface{}); ok {
+			if token, ok := signed["token"].(string); ok {
+				types = append(types, StateKeyTuple{"m.frame.third_party_invite", token})
+			}
+		}
+	}
+	if via, ok := event.Content["join_authorised_via_users_server"].(string); ok && via != "" {
+		types = append(types, StateKeyTuple{"m.frame.member", via})
+	}
+	return types
+}
+
+// AuthError is returned when an event is not allowed by the authorization rules.
+type AuthError struct {
+	EventType string
+	Reason    string
+}
+
+func (e AuthError) Error() string {
+	return fmt.Sprintf("%s event not allowed: %s", e.EventType, e.Reason)
+}
+
+// CheckAuthEvents fetches the auth events cited by the event and checks that they are the ones needed to
+// authorise it, with no duplicates, then checks the event against them with CheckEventAuth.
+func CheckAuthEvents(frameVersion string, event *PDU, fetcher EventFetcher) error {
+	allowed := make(map[StateKeyTuple]bool)
+	for _, key := range AuthTypes(event) {
+		allowed[key] = true
+	}
+	authEvents := make(AuthEvents)
+	for _, authID := range event.AuthEventIDs() {
+		authEvent, err := fetcher.FetchEvent(authID)
+		if err != nil {
+			return err
+		}
+		if authEvent.StateKey == nil {
+			return AuthError{EventType: event.Type, Reason: fmt.Sprintf("auth event %s is not a state event", authID)}
+		}
+		key := StateKeyTuple{authEvent.Type, *authEvent.StateKey}
+		if !allowed[key] {
+			return AuthError{EventType: event.Type, Reason: fmt.Sprintf("auth event %s (%s, %q) is not needed to authorise the event", authID, key.EventType, key.StateKey)}
+		}
+		if authEvents[key] != nil {
+			return AuthError{EventType: event.Type, Reason: fmt.Sprintf("duplicate auth events for (%s, %q)", key.EventType, key.StateKey)}
+		}
+		authEvents[key] = authEvent
+	}
+	return CheckEventAuth(frameVersion, event, authEvents)
+}
+
+// CheckEventAuth checks whether the event is allowed by the authorization rules of the frame version, given
+// the state events selected by AuthTypes. Returns an AuthError with the reason if not.
+func CheckEventAuth(frameVersion string, event *PDU, authEvents AuthEvents) error {
+	rules, err := GetFrameVersionRules(frameVersion)
+	if err != nil {
+		return err
+	}
+	a := authChecker{rules: rules, event: event, authEvents: authEvents}
+	return a.check()
+}
+
+// authChecker checks a single event against the authorization rules.
+type authChecker struct {
+	rules      FrameVersionRules
+	event      *PDU
+	authEvents AuthEvents
+	pl         *PowerLevels // the current power levels, from the auth events
+}
+
+func (a *authChecker) deny(format string, args ...interface{}) error {
+	return AuthError{EventType: a.event.Type, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (a *authChecker) isState(eventType string) bool {
+	return a.event.Type == eventType && a.event.StateKey != nil
+}
+
+func (a *authChecker) check() error {
+	event := a.event
+	if a.isState("m.frame.create") && *event.StateKey == "" {
+		return a.checkCreate()
+	}
+
+	create := a.authEvents.Get("m.frame.create", "")
+	if create == nil {
+		return a.deny("no m.frame.create event in the auth events")
+	}
+	if federate, ok := create.Content["m.federate"].(bool); ok && !federate && serverName(event.Sender) != serverName(create.Sender) {
+		return a.deny("the frame is not federated and %s is not on %s", event.Sender, serverName(create.Sender))
+	}
+	pl, err := a.authEvents.PowerLevels()
+	if err != nil {
+		return a.deny("invalid current power levels: %s", err)
+	}
+	if !a.rules.AuthCreateRequiresCreator {
+		pl.Creator = create.Sender
+	}
+	a.pl = pl
+
+	if a.rules.AuthAliasesSpecialCase && event.Type == "m.frame.aliases" {
+		if event.StateKey == nil {
+			return a.deny("m.frame.aliases must have a state key")
+		}
+		if *event.StateKey != serverName(event.Sender) {
+			return a.deny("the state key %q is not the server of %s", *event.StateKey, event.Sender)
+		}
+		return nil
+	}
+	if event.Type == "m.frame.member" {
+		return a.checkMember()
+	}
+	if a.authEvents.Membership(event.Sender) != MembershipJoin {
+		return a.deny("%s is not joined to the frame", event.Sender)
+	}
+	if a.isState("m.frame.third_party_invite") {
+		if !pl.CanInvite(event.Sender) {
+			return a.deny("%s has power level %d, but %d is needed to invite", event.Sender, pl.UserLevel(event.Sender), pl.InviteLevel())
+		}
+		return nil
+	}
+	if level, required := pl.UserLevel(event.Sender), pl.EventLevel(event.Type, event.StateKey != nil); level < required {
+		return a.deny("%s has power level %d, but %d is needed to send it", event.Sender, level, required)
+	}
+	if event.StateKey != nil && strings.HasPrefix(*event.StateKey, "@") && *event.StateKey != event.Sender {
+		return a.deny("only %s can send state with the state key %q", *event.StateKey, *event.StateKey)
+	}
+	if a.isState("m.frame.power_levels") && *event.StateKey == "" {
+		return a.checkPowerLevels()
+	}
+	if event.Type == "m.frame.redaction" && a.rules.AuthRedactionEventIDDomain {
+		if pl.UserLevel(event.Sender) >= pl.RedactLevel() {
+			return nil
+		}
+		if event.EventID != "" && serverName(event.EventID) == serverName(event.Redacts) {
+			return nil
+		}
+		return a.deny("%s can't redact events sent by other servers without power level %d", event.Sender, pl.RedactLevel())
+	}
+	return nil
+}
+
+func (a *authChecker) checkCreate() error {
+	event := a.event
+	if len(event.PrevEvents) > 0 {
+		return a.deny("the create event must be the first event in the frame")
+	}
+	if serverName(event.FrameID) != serverName(event.Sender) {
+		return a.deny("the frame ID %s is not on the server of the sender %s", event.FrameID, event.Sender)
+	}
+	if version, ok := event.Content["frame_version"]; ok {
+		str, isString := version.(string)
+		if _, err := GetFrameVersionRules(str); !isString || err != nil {
+			return a.deny("unknown frame version %v", version)
+		}
+	}
+	if a.rules.AuthCreateRequiresCreator {
+		if creator, ok := event.Content["creator"].(string); !ok || creator == "" {
+			return a.deny("missing creator")
+		}
+	}
+	return nil
+}
+
+func (a *authChecker) checkMember() error {
+	event := a.event
+	if event.StateKey == nil {
+		return a.deny("m.frame.member must have a state key")
+	}
+	membership, ok := event.Content["membership"].(string)
+	if !ok {
+		return a.deny("missing membership")
+	}
+	target := *event.StateKey
+	senderMembership := a.authEvents.Membership(event.Sender)
+	targetMembership := a.authEvents.Membership(target)
+	pl := a.pl
+
+	switch membership {
+	case MembershipJoin:
+		if a.isCreatorJoin() {
+			return nil
+		}
+		if event.Sender != target {
+			return a.deny("%s can't join on behalf of %s", event.Sender, target)
+		}
+		if senderMembership == MembershipBan {
+			return a.deny("%s is banned", event.Sender)
+		}
+		joinRule := a.joinRule()
+		switch {
+		case joinRule == JoinRulePublic:
+			return nil
+		case joinRule == JoinRuleInvite || (a.rules.AllowKnock && joinRule == JoinRuleKnock):
+			if senderMembership == MembershipJoin || senderMembership == MembershipInvite {
+				return nil
+			}
+			return a.deny("%s has not been invited", event.Sender)
+		case (a.rules.AllowRestricted && joinRule == JoinRuleRestricted) || (a.rules.AllowKnockRestricted && joinRule == JoinRuleKnockRestricted):
+			if senderMembership == MembershipJoin || senderMembership == MembershipInvite {
+				return nil
+			}
+			via, _ := event.Content["join_authorised_via_users_server"].(string)
+			if via == "" {
+				return a.deny("%s has not been invited and the join was not authorised by a member", event.Sender)
+			}
+			if a.authEvents.Membership(via) != MembershipJoin || !pl.CanInvite(via) {
+				return a.deny("%s can't authorise joins", via)
+			}
+			return nil
+		}
+		return a.deny("the join rule %q does not allow joining", joinRule)
+
+	case MembershipInvite:
+		if tpi, ok := event.Content["third_party_invite"]; ok {
+			return a.checkThirdPartyInvite(tpi, target, targetMembership)
+		}
+		if senderMembership != MembershipJoin {
+			return a.deny("%s is not joined to the frame", event.Sender)
+		}
+		if targetMembership == MembershipJoin || targetMembership == MembershipBan {
+			return a.deny("%s can't be invited as their membership is %q", target, targetMembership)
+		}
+		if !pl.CanInvite(event.Sender) {
+			return a.deny("%s has power level %d, but %d is needed to invite", event.Sender, pl.UserLevel(event.Sender), pl.InviteLevel())
+		}
+		return nil
+
+	case MembershipLeave:
+		if event.Sender == target {
+			switch senderMembership {
+			case MembershipJoin, MembershipInvite:
+				return nil
+			case MembershipKnock:
+				if a.rules.AllowKnock {
+					return nil
+				}
+			}
+			return a.deny("%s can't leave as their membership is %q", target, senderMembership)
+		}
+		if senderMembership != MembershipJoin {
+			return a.deny("%s is not joined to the frame", event.Sender)
+		}
+		if targetMembership == MembershipBan && pl.UserLevel(event.Sender) < pl.BanLevel() {
+			return a.deny("%s has power level %d, but %d is needed to unban", event.Sender, pl.UserLevel(event.Sender), pl.BanLevel())
+		}
+		if !pl.CanKick(event.Sender, target) {
+			return a.deny("%s needs power level %d and a higher power level than %s to kick them", event.Sender, pl.KickLevel(), target)
+		}
+		return nil
+
+	case MembershipBan:
+		if senderMembership != MembershipJoin {
+			return a.deny("%s is not joined to the frame", event.Sender)
+		}
+		if !pl.CanBan(event.Sender, target) {
+			return a.deny("%s needs power level %d and a higher power level than %s to ban them", event.Sender, pl.BanLevel(), target)
+		}
+		return nil
+
+	case MembershipKnock:
+		if !a.rules.AllowKnock {
+			break
+		}
+		joinRule := a.joinRule()
+		if joinRule != JoinRuleKnock && !(a.rules.AllowKnockRestricted && joinRule == JoinRuleKnockRestricted) {
+			return a.deny("the join rule %q does not allow knocking", joinRule)
+		}
+		if event.Sender != target {
+			return a.deny("%s can't knock on behalf of %s", event.Sender, target)
+		}
+		switch senderMembership {
+		case MembershipBan, MembershipInvite, MembershipJoin:
+			return a.deny("%s can't knock as their membership is %q", event.Sender, senderMembership)
+		}
+		return nil
+	}
+	return a.deny("unknown membership %q", membership)
+}
+
+// isCreatorJoin returns true if the event is the frame creator joining immediately after creating the frame.
+func (a *authChecker) isCreatorJoin() bool {
+	create := a.authEvents.Get("m.frame.create", "")
+	if len(a.event.PrevEvents) != 1 || *a.event.StateKey != a.pl.Creator {
+		return false
+	}
+	createID := create.EventID
+	if id, err := create.EventIDForVersion(a.rules.Version); err == nil {
+		createID = id
+	}
+	return a.event.PrevEvents[0].EventID == createID
+}
+
+// joinRule returns the current join rule, or "invite" if there is none.
+func (a *authChecker) joinRule() string {
+	if joinRules := a.authEvents.Get("m.frame.join_rules", ""); joinRules != nil {
+		if joinRule, ok := joinRules.Content["join_rule"].(string); ok {
+			return joinRule
+		}
+	}
+	return JoinRuleInvite
+}
+
+func (a *authChecker) checkThirdPartyInvite(tpi interface{}, target, targetMembership string) error {
+	if targetMembership == MembershipBan {
+		return a.deny("%s is banned", target)
+	}
+	invite, _ := tpi.(map[string]interface{})
+	signed, _ := invite["signed"].(map[string]interface{})
+	mxid, _ := signed["mxid"].(string)
+	token, _ := signed["token"].(string)
+	if mxid == "" || token == "" {
+		return a.deny("third party invite is missing the signed mxid or token")
+	}
+	if mxid != target {
+		return a.deny("third party invite is for %s, not %s", mxid, target)
+	}
+	tpiEvent := a.authEvents.Get("m.frame.third_party_invite", token)
+	if tpiEvent == nil {
+		return a.deny("no m.frame.third_party_invite event with the token %q", token)
+	}
+	if tpiEvent.Sender != a.event.Sender {
+		return a.deny("the third party invite was sent by %s, not %s", tpiEvent.Sender, a.event.Sender)
+	}
+	var publicKeys []string
+	if key, ok := tpiEvent.Content["public_key"].(string); ok {
+		publicKeys = append(publicKeys, key)
+	}
+	if keys, ok := tpiEvent.Content["public_keys"].([]interface{}); ok {
+		for _, k := range keys {
+			if keyObj, ok := k.(map[string]interface{}); ok {
+				if key, ok := keyObj["public_key"].(string); ok {
+					publicKeys = append(publicKeys, key)
+				}
+			}
+		}
+	}
+	if !verifyThirdPartySignatures(signed, publicKeys) {
+		return a.deny("no valid signature on the third party invite")
+	}
+	return nil
+}
+
+// verifyThirdPartySignatures returns true if any of the signatures of the signed object is a valid ed25519
+// signature by one of the public keys.
+func verifyThirdPartySignatures(signed map[string]interface{}, publicKeys []string) bool {
+	signatures, _ := signed["signatures"].(map[string]interface{})
+	unsigned := make(map[string]interface{}, len(signed))
+	for key, value := range signed {
+		if key != "signatures" && key != "unsigned" {
+			unsigned[key] = value
+		}
+	}
+	message, err := CanonicalJSON(unsigned)
+	if err != nil {
+		return false
+	}
+	for _, serverSignatures := range signatures {
+		keySignatures, _ := serverSignatures.(map[string]interface{})
+		for _, sig := range keySignatures {
+			sigStr, _ := sig.(string)
+			signature := decodeUnpaddedBase64(sigStr)
+			for _, publicKey := range publicKeys {
+				key := decodeUnpaddedBase64(publicKey)
+				if len(key) == ed25519.PublicKeySize && ed25519.Verify(key, message, signature) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// decodeUnpaddedBase64 decodes standard or URL-safe base64, with or without padding, returning nil if invalid.
+func decodeUnpaddedBase64(s string) []byte {
+	s = strings.TrimRight(s, "=")
+	if b, err := base64.RawStdEncoding.DecodeString(s); err == nil {
+		return b
+	}
+	b, _ := base64.RawURLEncoding.DecodeString(s)
+	return b
+}
+
+// powerLevelsFields are the single power levels in m.frame.power_levels content.
+var powerLevelsFields = []string{"users_default", "events_default", "state_default", "ban", "redact", "kick", "invite"}
+
+func (a *authChecker) checkPowerLevels() error {
+	content := a.event.Content
+	for _, field := range powerLevelsFields {
+		if value, ok := content[field]; ok {
+			if _, valid := authPowerLevel(value, a.rules.AuthIntegerPowerLevels); !valid {
+				return a.deny("%s must be an integer", field)
+			}
+		}
+	}
+	for _, field := range []string{"events", "notifications", "users"} {
+		levels, ok := content[field]
+		if !ok {
+			continue
+		}
+		levelMap, ok := levels.(map[string]interface{})
+		if !ok {
+			return a.deny("%s must be an object", field)
+		}
+		for key, value := range levelMap {
+			if _, valid := authPowerLevel(value, a.rules.AuthIntegerPowerLevels); !valid {
+				return a.deny("%s.%s must be an integer", field, key)
+			}
+			if field == "users" && !isValidUserID(key) {
+				return a.deny("%q in users is not a user ID", key)
+			}
+		}
+	}
+
+	old := a.authEvents.Get("m.frame.power_levels", "")
+	if old == nil {
+		return nil
+	}
+	sender := a.event.Sender
+	senderLevel := a.pl.UserLevel(sender)
+	checkChange := func(name string, oldValue, newValue interface{}, oldExists, newExists bool) error {
+		oldLevel, _ := authPowerLevel(oldValue, false)
+		newLevel, _ := authPowerLevel(newValue, false)
+		if oldExists == newExists && oldLevel == newLevel {
+			return nil
+		}
+		if oldExists && oldLevel > senderLevel {
+			return a.deny("%s has power level %d and can't change %s from %d", sender, senderLevel, name, oldLevel)
+		}
+		if newExists && newLevel > senderLevel {
+			return a.deny("%s has power level %d and can't change %s to %d", sender, senderLevel, name, newLevel)
+		}
+		return nil
+	}
+	for _, field := range powerLevelsFields {
+		oldValue, oldExists := old.Content[field]
+		newValue, newExists := content[field]
+		if err := checkChange(field, oldValue, newValue, oldExists, newExists); err != nil {
+			return err
+		}
+	}
+	mapFields := []string{"events"}
+	if a.rules.AuthNotificationsPowerLevels {
+		mapFields = append(mapFields, "notifications")
+	}
+	for _, field := range append(mapFields, "users") {
+		oldMap, _ := old.Content[field].(map[string]interface{})
+		newMap, _ := content[field].(map[string]interface{})
+		keys := make(map[string]bool)
+		for key := range oldMap {
+			keys[key] = true
+		}
+		for key := range newMap {
+			keys[key] = true
+		}
+		for key := range keys {
+			oldValue, oldExists := oldMap[key]
+			newValue, newExists := newMap[key]
+			if field == "users" && key != sender && oldExists {
+				oldLevel, _ := authPowerLevel(oldValue, false)
+				newLevel, _ := authPowerLevel(newValue, false)
+				if (!newExists || oldLevel != newLevel) && oldLevel >= senderLevel {
+					return a.deny("%s has power level %d and can't change the power level of %s from %d", sender, senderLevel, key, oldLevel)
+				}
+			}
+			if err := checkChange(field+"."+key, oldValue, newValue, oldExists, newExists); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// authPowerLevel parses a power level from event content. Strings containing integers are allowed unless
+// integersOnly is set.
+func authPowerLevel(value interface{}, integersOnly bool) (int64, bool) {
+	switch v := value.(type) {
+	case float64:
+		if v != math.Trunc(v) || math.Abs(v) > 1<<53-1 {
+			return 0, false
+		}
+		return int64(v), true
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	case string:
+		if integersOnly {
+			return 0, false
+		}
+		i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
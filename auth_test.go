@@ -0,0 +1,122 @@
+package xcore
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func authTestPDU(t *testing.T, eventType, stateKey, sender, content string) *PDU {
+	t.Helper()
+	pdu := &PDU{FrameID: "!frame:example.org", Type: eventType, StateKey: &stateKey, Sender: sender}
+	if err := json.Unmarshal([]byte(content), &pdu.Content); err != nil {
+		t.Fatal(err)
+	}
+	return pdu
+}
+
+// authTestFrame returns the auth events of a frame created by Alice (100) in which Bob and Carol (50) and
+// Erin (0) are joined. Banning and inviting need 50.
+func authTestFrame(t *testing.T, joinRule string) AuthEvents {
+	authEvents := make(AuthEvents)
+	authEvents.Add(authTestPDU(t, "m.frame.create", "", "@alice:example.org", `{"creator":"@alice:example.org"}`))
+	authEvents.Add(authTestPDU(t, "m.frame.power_levels", "", "@alice:example.org",
+		`{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":50},"state_default":50,"ban":50,"invite":50}`))
+	authEvents.Add(authTestPDU(t, "m.frame.join_rules", "", "@alice:example.org", `{"join_rule":"`+joinRule+`"}`))
+	for _, userID := range []string{"@alice:example.org", "@bob:example.org", "@carol:example.org", "@erin:example.org"} {
+		authEvents.Add(authTestPDU(t, "m.frame.member", userID, userID, `{"membership":"join"}`))
+	}
+	return authEvents
+}
+
+func checkAuthTestCase(t *testing.T, name, frameVersion string, event *PDU, authEvents AuthEvents, allowed bool) {
+	t.Helper()
+	err := CheckEventAuth(frameVersion, event, authEvents)
+	var authErr AuthError
+	switch {
+	case allowed && err != nil:
+		t.Errorf("%s: expected event to be allowed, got %v", name, err)
+	case !allowed && err == nil:
+		t.Errorf("%s: expected event to be rejected", name)
+	case !allowed && !errors.As(err, &authErr):
+		t.Errorf("%s: expected an AuthError, got %v", name, err)
+	}
+}
+
+func TestCheckEventAuthPowerLevelChanges(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		sender  string
+		content string
+		allowed bool
+	}{
+		{"raise own level above own", "@bob:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":60,"@carol:example.org":50},"state_default":50,"ban":50,"invite":50}`, false},
+		{"lower own level", "@bob:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":0,"@carol:example.org":50},"state_default":50,"ban":50,"invite":50}`, true},
+		{"lower user at own level", "@bob:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":0},"state_default":50,"ban":50,"invite":50}`, false},
+		{"remove user at own level", "@bob:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":50},"state_default":50,"ban":50,"invite":50}`, false},
+		{"lower user below own level", "@alice:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":0,"@carol:example.org":50},"state_default":50,"ban":50,"invite":50}`, true},
+		{"promote user to own level", "@bob:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":50,"@erin:example.org":50},"state_default":50,"ban":50,"invite":50}`, true},
+		{"promote user above own level", "@bob:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":50,"@erin:example.org":51},"state_default":50,"ban":50,"invite":50}`, false},
+		{"raise ban level above own", "@bob:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":50},"state_default":50,"ban":60,"invite":50}`, false},
+		{"lower ban level", "@bob:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":50},"state_default":50,"ban":40,"invite":50}`, true},
+		{"raise ban level as creator", "@alice:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":50},"state_default":50,"ban":100,"invite":50}`, true},
+		{"add event level above own", "@bob:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":50},"state_default":50,"ban":50,"invite":50,"events":{"m.frame.name":75}}`, false},
+		{"below state_default", "@erin:example.org",
+			`{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":50},"state_default":50,"ban":50,"invite":50}`, false},
+	} {
+		event := authTestPDU(t, "m.frame.power_levels", "", tc.sender, tc.content)
+		checkAuthTestCase(t, tc.name, "10", event, authTestFrame(t, JoinRuleInvite), tc.allowed)
+	}
+}
+
+func TestCheckEventAuthRestrictedJoin(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		frameVersion string
+		joinRule     string
+		via          string
+		allowed      bool
+	}{
+		{"authorised by member with invite power", "10", JoinRuleRestricted, "@bob:example.org", true},
+		{"authorised by member in v8", "8", JoinRuleRestricted, "@bob:example.org", true},
+		{"authorised by member without invite power", "10", JoinRuleRestricted, "@erin:example.org", false},
+		{"authorised by non-member", "10", JoinRuleRestricted, "@dave:example.org", false},
+		{"not authorised", "10", JoinRuleRestricted, "", false},
+		{"restricted before v8", "7", JoinRuleRestricted, "@bob:example.org", false},
+		{"knock_restricted", "10", JoinRuleKnockRestricted, "@bob:example.org", true},
+		{"knock_restricted before v10", "9", JoinRuleKnockRestricted, "@bob:example.org", false},
+	} {
+		content := `{"membership":"join"}`
+		if tc.via != "" {
+			content = `{"membership":"join","join_authorised_via_users_server":"` + tc.via + `"}`
+		}
+		event := authTestPDU(t, "m.frame.member", "@zara:example.org", "@zara:example.org", content)
+		checkAuthTestCase(t, tc.name, tc.frameVersion, event, authTestFrame(t, tc.joinRule), tc.allowed)
+	}
+}
+
+func TestCheckEventAuthStringPowerLevels(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+	}{
+		{"string ban level", `{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":50},"state_default":50,"ban":"50","invite":50}`},
+		{"string user level", `{"users":{"@alice:example.org":100,"@bob:example.org":"50","@carol:example.org":50},"state_default":50,"ban":50,"invite":50}`},
+		{"string event level", `{"users":{"@alice:example.org":100,"@bob:example.org":50,"@carol:example.org":50},"state_default":50,"ban":50,"invite":50,"events":{"m.frame.name":"50"}}`},
+	} {
+		event := authTestPDU(t, "m.frame.power_levels", "", "@alice:example.org", tc.content)
+		checkAuthTestCase(t, tc.name+" in v1", "1", event, authTestFrame(t, JoinRuleInvite), true)
+		checkAuthTestCase(t, tc.name+" in v10", "10", event, authTestFrame(t, JoinRuleInvite), false)
+	}
+}
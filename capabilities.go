@@ -0,0 +1,208 @@
+package xcore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// The stability of a frame version in the m.frame_versions capability.
+const (
+	FrameVersionStable   = "stable"
+	FrameVersionUnstable = "unstable"
+)
+
+// BooleanCapability is a capability which is either enabled or disabled.
+type BooleanCapability struct {
+	Enabled bool `json:"enabled"`
+}
+
+// FrameVersionsCapability is the m.frame_versions capability: the frame versions supported by the server.
+type FrameVersionsCapability struct {
+	Default   string            `json:"default"`
+	Available map[string]string `json:"available"` // frame version to FrameVersionStable or FrameVersionUnstable
+}
+
+// IsAvailable returns true if the server supports the frame version.
+func (c *FrameVersionsCapability) IsAvailable(frameVersion string) bool {
+	_, ok := c.Available[frameVersion]
+	return ok
+}
+
+// IsStable returns true if the server supports the frame version and considers it stable.
+func (c *FrameVersionsCapability) IsStable(frameVersion string) bool {
+	return c.Available[frameVersion] == FrameVersionStable
+}
+
+// Stable returns the stable frame versions supported by the server, sorted.
+func (c *FrameVersionsCapability) Stable() []string {
+	var versions []string
+	for version, stability := range c.Available {
+		if stability == FrameVersionStable {
+			versions = append(versions, version)
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Pick returns the first of the wanted frame versions which the server supports and considers stable, or the
+// server's default version if there is none.
+func (c *FrameVersionsCapability) Pick(wanted ...string) string {
+	for _, version := range wanted {
+		if c.IsStable(version) {
+			return version
+		}
+	}
+	return c.Default
+}
+
+// Capabilities are the capabilities of the homeserver. Capabilities which aren't known by this library are kept
+// in Extra.
+type Capabilities struct {
+	ChangePassword  *BooleanCapability       `json:"m.change_password,omitempty"`
+	SetDisplayName  *BooleanCapability       `json:"m.set_displayname,omitempty"`
+	SetAvatarURL    *BooleanCapability       `json:"m.set_avatar_url,omitempty"`
+	ThreePIDChanges *BooleanCapability       `json:"m.3pid_changes,omitempty"`
+	FrameVersions   *FrameVersionsCapability `json:"m.frame_versions,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// knownCapabilities are the capabilities handled by the fields of Capabilities.
+var knownCapabilities = []string{"m.change_password", "m.set_displayname", "m.set_avatar_url", "m.3pid_changes", "m.frame_versions"}
+
+// capabilitiesFields has the same fields as Capabilities but without its JSON methods.
+type capabilitiesFields Capabilities
+
+// UnmarshalJSON implements json.Unmarshaler, keeping unknown capabilities in Extra.
+func (c *Capabilities) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*capabilitiesFields)(c)); err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	c.Extra = nil
+	for key, value := range all {
+		if !containsString(knownCapabilities, key) {
+			if c.Extra == nil {
+				c.Extra = make(map[string]json.RawMessage)
+			}
+			c.Extra[key] = value
+		}
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, including the capabilities in Extra.
+func (c Capabilities) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(capabilitiesFields(c))
+	if err != nil || len(c.Extra) == 0 {
+		return b, err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range c.Extra {
+		if _, exists := fields[key]; !exists {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// enabledByDefault returns whether the boolean capability is enabled, which it is if the server doesn't list it.
+func enabledByDefault(capability *BooleanCapability) bool {
+	return capability == nil || capability.Enabled
+}
+
+// CanChangePassword returns true if the user can change their password.
+func (c *Capabilities) CanChangePassword() bool { return enabledByDefault(c.ChangePassword) }
+
+// CanSetDisplayName returns true if the user can change their display name.
+func (c *Capabilities) CanSetDisplayName() bool { return enabledByDefault(c.SetDisplayName) }
+
+// CanSetAvatarURL returns true if the user can change their avatar.
+func (c *Capabilities) CanSetAvatarURL() bool { return enabledByDefault(c.SetAvatarURL) }
+
+// CanChangeThreePIDs returns true if the user can add and remove third party identifiers.
+func (c *Capabilities) CanChangeThreePIDs() bool { return enabledByDefault(c.ThreePIDChanges) }
+
+// clone returns a deep copy of the capabilities.
+func (c *Capabilities) clone() *Capabilities {
+	copyBool := func(capability *BooleanCapability) *BooleanCapability {
+		if capability == nil {
+			return nil
+		}
+		copied := *capability
+		return &copied
+	}
+	clone := &Capabilities{
+		ChangePassword:  copyBool(c.ChangePassword),
+		SetDisplayName:  copyBool(c.SetDisplayName),
+		SetAvatarURL:    copyBool(c.SetAvatarURL),
+		ThreePIDChanges: copyBool(c.ThreePIDChanges),
+	}
+	if c.FrameVersions != nil {
+		clone.FrameVersions = &FrameVersionsCapability{Default: c.FrameVersions.Default}
+		if c.FrameVersions.Available != nil {
+			clone.FrameVersions.Available = make(map[string]string, len(c.FrameVersions.Available))
+			for version, stability := range c.FrameVersions.Available {
+				clone.FrameVersions.Available[version] = stability
+			}
+		}
+	}
+	if c.Extra != nil {
+		clone.Extra = make(map[string]json.RawMessage, len(c.Extra))
+		for key, value := range c.Extra {
+			clone.Extra[key] = append(json.RawMessage(nil), value...)
+		}
+	}
+	return clone
+}
+
+// Capabilities returns the capabilities of the homeserver, fetching them the first time they are needed.
+// The result is a copy of the cached capabilities, so it may be modified freely.
+// Use RefreshCapabilities to fetch them again. See get-coddy-client-r0-capabilities
+func (cli *Client) Capabilities() (*Capabilities, error) {
+	cli.capabilitiesMutex.Lock()
+	caps := cli.capabilities
+	cli.capabilitiesMutex.Unlock()
+	if caps != nil {
+		return caps.clone(), nil
+	}
+	return cli.RefreshCapabilities()
+}
+
+// RefreshCapabilities fetches the capabilities of the homeserver and caches them on the client.
+func (cli *Client) RefreshCapabilities() (*Capabilities, error) {
+	var resp RespCapabilities
+	if err := cli.MakeRequest("GET", cli.BuildURL("capabilities"), nil, &resp); err != nil {
+		return nil, err
+	}
+	cli.capabilitiesMutex.Lock()
+	cli.capabilities = resp.Capabilities.clone()
+	cli.capabilitiesMutex.Unlock()
+	return &resp.Capabilities, nil
+}
+
+// frameVersionFor returns the frame version to create a frame with: the requested version after checking that
+// the homeserver supports it, or the homeserver's default version if none was requested. Homeservers which
+// don't advertise the m.frame_versions capability, or whose capabilities can't be fetched, are assumed to
+// support the requested version, and the requested version is returned unchanged.
+func (cli *Client) frameVersionFor(frameVersion string) (string, error) {
+	caps, err := cli.Capabilities()
+	if err != nil || caps.FrameVersions == nil {
+		return frameVersion, nil
+	}
+	if frameVersion == "" {
+		return caps.FrameVersions.Default, nil
+	}
+	if !caps.FrameVersions.IsAvailable(frameVersion) {
+		return "", fmt.Errorf("the homeserver does not support frame version %q", frameVersion)
+	}
+	return frameVersion, nil
+}
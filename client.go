@@ -16,20 +16,34 @@ import (
 
 // Client represents a Coddy client.
 type Client struct {
-	HomeserverURL *url.URL     // The base homeserver URL
-	Prefix        string       // The API prefix eg '/_coddy/client/r0'
-	UserID        string       // The user ID of the client. Used for forming HTTP paths which use the client's user ID.
-	AccessToken   string       // The access_token for the client.
-	Client        *http.Client // The underlying HTTP client which will be used to make HTTP requests.
-	Syncer        Syncer       // The thing which can process /sync responses
-	Store         Storer       // The thing which can store frames/tokens/ids
+	HomeserverURL *url.URL       // The base homeserver URL
+	Prefix        string         // The API prefix eg '/_coddy/client/r0'
+	UserID        string         // The user ID of the client. Used for forming HTTP paths which use the client's user ID.
+	AccessToken   string         // The access_token for the client.
+	Client        *http.Client   // The underlying HTTP client which will be used to make HTTP requests.
+	Syncer        Syncer         // The thing which can process /sync responses
+	Store         Storer         // The thing which can store frames/tokens/ids
+	Pending       *PendingEvents // The thing which tracks sent message events until they come down /sync. Nil unless TrackPendingEvents is called.
 
 	// The ?user_id= query parameter for application services. This must be set *prior* to calling a method. If this is empty,
 	// no user_id parameter will be sent.
 	AppServiceUserID string
 
+	// If true, events are not checked with ValidateEvent before they are sent.
+	SkipEventValidation bool
+
+	// If true, CreateFrame doesn't check that the requested frame version is supported by the homeserver, and
+	// doesn't fill in the homeserver's default version when none is requested.
+	SkipFrameVersionCheck bool
+
+	// The options used by Sync. These must be set *prior* to calling Sync.
+	SyncOptions SyncOptions
+
 	syncingMutex sync.Mutex // protects syncingID
 	syncingID    uint32     // Identifies the current Sync. Only one Sync can be active at any given time.
+
+	capabilitiesMutex sync.Mutex    // protects capabilities
+	capabilities      *Capabilities // The cached capabilities of the homeserver. Nil until they are first fetched.
 }
 
 // HTTPError An HTTP Error response, which may wrap an underlying native Go Error.
@@ -105,6 +119,9 @@ func (cli *Client) ClearCredentials() {
 //   - The failure to create a filter.
 //   - Client.Syncer.OnFailedSync returning an error in response to a failed sync.
 //   - Client.Syncer.ProcessResponse returning an error.
+//   - Client.SyncOptions.OnIteration returning an error.
+//
+// The requests are configured by Client.SyncOptions.
 //
 // If you wish to continue retrying in spite of these fatal errors, call Sync() again.
 func (cli *Client) Sync() error {
@@ -124,8 +141,16 @@ func (cli *Client) Sync() error {
 		cli.Store.SaveFilterID(cli.UserID, filterID)
 	}
 
+	opts := cli.SyncOptions
+	fullState := opts.FullStateOnFirstSync
+	catchingUp := opts.CatchUp
+	catchUpSyncs := 0
 	for {
-		resSync, err := cli.SyncRequest(30000, nextBatch, filterID, false, "")
+		timeout := opts.timeout()
+		if catchingUp {
+			timeout = 0
+		}
+		resSync, err := cli.SyncRequest(timeout, nextBatch, filterID, fullState, opts.SetPresence)
 		if err != nil {
 			duration, err2 := cli.Syncer.OnFailedSync(resSync, err)
 			if err2 != nil {
@@ -146,9 +171,30 @@ func (cli *Client) Sync() error {
 		// to not process some events, but it means that we won't get constantly stuck processing
 		// a malformed/buggy event which keeps making us panic.
 		cli.Store.SaveNextBatch(cli.UserID, resSync.NextBatch)
+		if catchingUp {
+			catchUpSyncs++
+		}
+		// Checked before the syncer can modify the response
+		caughtUp := catchingUp && (!resSync.hasFrameUpdates() || resSync.NextBatch == nextBatch || catchUpSyncs >= MaxCatchUpSyncs)
 		if err = cli.Syncer.ProcessResponse(resSync, nextBatch); err != nil {
 			return err
 		}
+		fullState = false
+
+		if opts.OnIteration != nil {
+			iteration := &SyncIteration{
+				Since:      nextBatch,
+				Response:   resSync,
+				CatchingUp: catchingUp,
+				CaughtUp:   caughtUp,
+			}
+			if err = opts.OnIteration(iteration); err != nil {
+				return err
+			}
+		}
+		if caughtUp {
+			catchingUp = false
+		}
 
 		nextBatch = resSync.NextBatch
 	}
@@ -440,6 +486,20 @@ func (cli *Client) JoinFrame(frameIDorAlias, serverName string, content interfac
 	return
 }
 
+// KnockFrame asks to join a frame with a knock or knock_restricted join rule. serverNames are servers to send the
+// knock through, which are needed if the homeserver isn't already in the frame.
+// See post-coddy-client-r0-knock-frameidoralias
+func (cli *Client) KnockFrame(frameIDorAlias, reason string, serverNames []string) (resp *RespKnockFrame, err error) {
+	u, _ := url.Parse(cli.BuildURL("knock", frameIDorAlias))
+	q := u.Query()
+	for _, serverName := range serverNames {
+		q.Add("server_name", serverName)
+	}
+	u.RawQuery = q.Encode()
+	err = cli.MakeRequest("POST", u.String(), &ReqKnockFrame{Reason: reason}, &resp)
+	return
+}
+
 // GetDisplayName returns the display name of the user from the specified MXID. See get-coddy-client-r0-profile-userid-displayname
 func (cli *Client) GetDisplayName(mxid string) (resp *RespUserDisplayName, err error) {
 	urlPath := cli.BuildURL("profile", mxid, "displayname")
@@ -519,20 +579,88 @@ func (cli *Client) SetStatus(presence, status string) (err error) {
 // SendMessageEvent sends a message event into a frame. See put-coddy-client-r0-frames-frameid-send-eventtype-txnid
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
 func (cli *Client) SendMessageEvent(frameID string, eventType string, contentJSON interface{}) (resp *RespSendEvent, err error) {
-	txnID := txnID()
+	if err = cli.validateEvent(frameID, eventType, nil, contentJSON); err != nil {
+		return
+	}
+	return cli.sendMessageEvent(frameID, eventType, txnID(), contentJSON)
+}
+
+// SendMessageEventWithTxnID sends a message event into a frame using the given transaction ID, rather than
+// generating one. This allows callers to know the transaction ID of the event before it is sent, e.g to
+// display a local echo. Sending with the same transaction ID again will not send a duplicate event.
+// See put-coddy-client-r0-frames-frameid-send-eventtype-txnid
+func (cli *Client) SendMessageEventWithTxnID(frameID, eventType, txnID string, contentJSON interface{}) (resp *RespSendEvent, err error) {
+	if err = cli.validateEvent(frameID, eventType, nil, contentJSON); err != nil {
+		return
+	}
+	return cli.sendMessageEvent(frameID, eventType, txnID, contentJSON)
+}
+
+// sendMessageEvent sends a message event, tracking it in cli.Pending if set.
+func (cli *Client) sendMessageEvent(frameID, eventType, txnID string, contentJSON interface{}) (resp *RespSendEvent, err error) {
+	if cli.Pending != nil {
+		cli.Pending.sending(txnID, frameID, eventType, contentJSON)
+	}
 	urlPath := cli.BuildURL("frames", frameID, "send", eventType, txnID)
 	err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+	if cli.Pending != nil {
+		cli.Pending.sent(txnID, resp, err)
+	}
 	return
 }
 
+// TrackPendingEvents starts tracking the message events sent by the client until they come back down /sync, and
+// returns the tracker. If the client uses a DefaultSyncer, its echoes are matched automatically; otherwise the
+// syncer must call PendingEvents.Match. See PendingEvents.
+func (cli *Client) TrackPendingEvents() *PendingEvents {
+	if cli.Pending == nil {
+		cli.Pending = NewPendingEvents()
+	}
+	if syncer, ok := cli.Syncer.(*DefaultSyncer); ok {
+		syncer.Pending = cli.Pending
+	}
+	return cli.Pending
+}
+
+// RetryPendingEvent sends a failed pending event again, using the same transaction ID. See PendingEvents.
+func (cli *Client) RetryPendingEvent(txnID string) (*RespSendEvent, error) {
+	if cli.Pending == nil {
+		return nil, ErrUnknownPendingEvent
+	}
+	pending, ok := cli.Pending.Get(txnID)
+	if !ok {
+		return nil, ErrUnknownPendingEvent
+	}
+	if pending.Status != PendingEventFailed {
+		return nil, fmt.Errorf("cannot retry event %s: it is %s", txnID, pending.Status)
+	}
+	return cli.sendMessageEvent(pending.FrameID, pending.Type, txnID, pending.Content)
+}
+
 // SendStateEvent sends a state event into a frame. See put-coddy-client-r0-frames-frameid-state-eventtype-statekey
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
 func (cli *Client) SendStateEvent(frameID, eventType, stateKey string, contentJSON interface{}) (resp *RespSendEvent, err error) {
+	if err = cli.validateEvent(frameID, eventType, &stateKey, contentJSON); err != nil {
+		return
+	}
 	urlPath := cli.BuildURL("frames", frameID, "state", eventType, stateKey)
 	err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
 	return
 }
 
+// validateEvent checks an event which is about to be sent by this client, unless SkipEventValidation is set.
+func (cli *Client) validateEvent(frameID, eventType string, stateKey *string, content interface{}) error {
+	if cli.SkipEventValidation {
+		return nil
+	}
+	return validateEvent(&Event{
+		Type:     eventType,
+		StateKey: stateKey,
+		Sender:   cli.UserID,
+		FrameID:  frameID,
+	}, content)
+}
+
 // SendText sends an m.frame.message event into the given frame with a msgtype of m.text
 // See m-text
 func (cli *Client) SendText(frameID, text string) (*RespSendEvent, error) {
@@ -547,6 +675,24 @@ func (cli *Client) SendFormattedText(frameID, text, formattedText string) (*Resp
 		TextMessage{MsgType: "m.text", Body: text, FormattedBody: formattedText, Format: "org.coddy.custom.html"})
 }
 
+// SendMarkdown sends an m.frame.message event into the given frame with a msgtype of m.text, rendering the given
+// CommonMark into formatted_body. See RenderMarkdown.
+func (cli *Client) SendMarkdown(frameID, md string) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(frameID, "m.frame.message", RenderMarkdown(md))
+}
+
+// SendMention sends an m.frame.message event into the given frame which mentions the given users.
+// See NewMentionMessage.
+func (cli *Client) SendMention(frameID, text string, userIDs []string, displayNames map[string]string) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(frameID, "m.frame.message", NewMentionMessage(text, userIDs, displayNames))
+}
+
+// SendFrameMention sends an m.frame.message event into the given frame which mentions everyone in it.
+// See NewFrameMentionMessage.
+func (cli *Client) SendFrameMention(frameID, text string) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(frameID, "m.frame.message", NewFrameMentionMessage(text))
+}
+
 // SendImage sends an m.frame.message event into the given frame with a msgtype of m.image
 // See m-image
 func (cli *Client) SendImage(frameID, body, url string) (*RespSendEvent, error) {
@@ -576,6 +722,33 @@ func (cli *Client) SendNotice(frameID, text string) (*RespSendEvent, error) {
 		TextMessage{MsgType: "m.notice", Body: text})
 }
 
+// SendPollStart starts a poll in the given frame. See NewPollStart.
+func (cli *Client) SendPollStart(frameID, question string, answers []string, kind string, maxSelections int) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(frameID, "m.poll.start", NewPollStart(question, answers, kind, maxSelections))
+}
+
+// SendPollResponse votes for the given answer IDs in the poll started by pollEventID. Sending an empty list
+// of answer IDs withdraws any previous vote.
+func (cli *Client) SendPollResponse(frameID, pollEventID string, answerIDs ...string) (*RespSendEvent, error) {
+	if answerIDs == nil {
+		answerIDs = []string{}
+	}
+	return cli.SendMessageEvent(frameID, "m.poll.response", PollResponseContent{
+		RelatesTo:  RelatesTo{RelType: "m.reference", EventID: pollEventID},
+		Selections: answerIDs,
+	})
+}
+
+// SendPollEnd closes the poll started by pollEventID. text is shown to clients which don't support polls. If
+// results is non-nil, it is included as the final tally of votes per answer ID.
+func (cli *Client) SendPollEnd(frameID, pollEventID, text string, results map[string]int) (*RespSendEvent, error) {
+	return cli.SendMessageEvent(frameID, "m.poll.end", PollEndContent{
+		RelatesTo: RelatesTo{RelType: "m.reference", EventID: pollEventID},
+		Text:      []TextRepresentation{{Body: text}},
+		Results:   results,
+	})
+}
+
 // RedactEvent redacts the given event. See put-coddy-client-r0-frames-frameid-redact-eventid-txnid
 func (cli *Client) RedactEvent(frameID, eventID string, req *ReqRedact) (resp *RespSendEvent, err error) {
 	txnID := txnID()
@@ -590,13 +763,31 @@ func (cli *Client) MarkRead(frameID, eventID string) error {
 	return cli.MakeRequest("POST", urlPath, nil, nil)
 }
 
-// CreateFrame creates a new Coddy frame. See post-coddy-client-r0-createframe
+// CreateFrame creates a new Coddy frame. Unless SkipFrameVersionCheck is set, the requested frame version is
+// checked against the homeserver's capabilities, and the homeserver's default version is requested if
+// req.FrameVersion is empty. req itself is not modified. See post-coddy-client-r0-createframe
 //
 //	resp, err := cli.CreateFrame(&gocoddy.ReqCreateFrame{
 //		Preset: "public_chat",
 //	})
 //	fmt.Println("Frame:", resp.FrameID)
 func (cli *Client) CreateFrame(req *ReqCreateFrame) (resp *RespCreateFrame, err error) {
+	if !cli.SkipEventValidation {
+		if err = ValidateCreateFrame(req); err != nil {
+			return
+		}
+	}
+	if !cli.SkipFrameVersionCheck {
+		var frameVersion string
+		if frameVersion, err = cli.frameVersionFor(req.FrameVersion); err != nil {
+			return
+		}
+		if frameVersion != req.FrameVersion {
+			withVersion := *req
+			withVersion.FrameVersion = frameVersion
+			req = &withVersion
+		}
+	}
 	urlPath := cli.BuildURL("createFrame")
 	err = cli.MakeRequest("POST", urlPath, req, &resp)
 	return
@@ -1,21 +1,177 @@
 package xcore
 
 import (
-	"html"
-	"regexp"
+	"encoding/json"
+	"reflect"
 )
 
+// Event represents a single Coddy event.
+//
+// Top-level fields which aren't known to this struct are kept in Extra, so that an event can be unmarshalled and
+// marshalled again without losing data.
 type Event struct {
 	StateKey    *string                `json:"state_key,omitempty"`    // The state key for the event. Only present on State Events.
 	Sender      string                 `json:"sender"`                 // The user ID of the sender of the event
 	Type        string                 `json:"type"`                   // The event type
 	Timestamp   int64                  `json:"origin_server_ts"`       // The unix timestamp when this message was sent by the origin server
 	ID          string                 `json:"event_id"`               // The unique ID of this event
-	FrameID      string                 `json:"frame_id"`                // The frame the event was sent to. May be nil (e.g. for presence)
+	FrameID     string                 `json:"frame_id"`               // The frame the event was sent to. May be nil (e.g. for presence)
 	Redacts     string                 `json:"redacts,omitempty"`      // The event ID that was redacted if a m.frame.redaction event
 	Unsigned    map[string]interface{} `json:"unsigned"`               // The unsigned portions of the event, such as age and prev_content
 	Content     map[string]interface{} `json:"content"`                // The JSON content of the event.
 	PrevContent map[string]interface{} `json:"prev_content,omitempty"` // The JSON prev_content of the event.
+
+	Extra map[string]json.RawMessage `json:"-"` // Top-level fields not listed above, e.g federation fields
+	Raw   json.RawMessage            `json:"-"` // The JSON the event was unmarshalled from. Not updated if the event is modified.
+}
+
+// knownEventFields are the top-level keys handled by the fields of Event.
+var knownEventFields = []string{
+	"state_key", "sender", "type", "origin_server_ts", "event_id", "frame_id", "redacts", "unsigned", "content", "prev_content",
+}
+
+// eventFields has the same fields as Event but without its JSON methods.
+type eventFields Event
+
+// UnmarshalJSON implements json.Unmarshaler, keeping unknown fields in Extra and the input in Raw.
+func (event *Event) UnmarshalJSON(data []byte) error {
+	var fields eventFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	var extra map[string]json.RawMessage
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return err
+	}
+	for _, key := range knownEventFields {
+		delete(extra, key)
+	}
+	if len(extra) == 0 {
+		extra = nil
+	}
+	*event = Event(fields)
+	event.Extra = extra
+	event.Raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler. Events which haven't been modified since they were unmarshalled are
+// encoded as Raw, so they are copied faithfully. Other events include any unknown fields from Extra, with known
+// fields taking precedence over fields with the same key in Extra.
+func (event Event) MarshalJSON() ([]byte, error) {
+	if event.unmodified() {
+		return event.Raw, nil
+	}
+	known, err := json.Marshal(eventFields(event))
+	if err != nil || len(event.Extra) == 0 {
+		return known, err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(known, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range event.Extra {
+		if _, exists := fields[key]; !exists {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// unmodified returns true if the event has a Raw encoding which it is still equal to.
+func (event *Event) unmodified() bool {
+	if len(event.Raw) == 0 {
+		return false
+	}
+	var original Event
+	if err := original.UnmarshalJSON(event.Raw); err != nil {
+		return false
+	}
+	current := *event
+	current.Raw = original.Raw
+	return reflect.DeepEqual(original, current)
+}
+
+// unmarshalUnsigned unmarshals the given key of the unsigned data into out, returning false if the key is missing
+// or can't be unmarshalled.
+func (event *Event) unmarshalUnsigned(key string, out interface{}) bool {
+	value, exists := event.Unsigned[key]
+	if !exists || value == nil {
+		return false
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, out) == nil
+}
+
+// Age returns the time in milliseconds since the event was sent, as of when it was received from the server.
+func (event *Event) Age() (age int64, ok bool) {
+	ok = event.unmarshalUnsigned("age", &age)
+	return
+}
+
+// TransactionID returns the transaction ID the event was sent with. This is only present on events sent by
+// the same client (device) which is receiving them.
+func (event *Event) TransactionID() string {
+	txnID, _ := event.Unsigned["transaction_id"].(string)
+	return txnID
+}
+
+// RedactedBecause returns the redaction event which redacted this event, or nil if it hasn't been redacted.
+func (event *Event) RedactedBecause() *Event {
+	var redaction Event
+	if !event.unmarshalUnsigned("redacted_because", &redaction) {
+		return nil
+	}
+	return &redaction
+}
+
+// PreviousContent returns the content of the state event this state event replaced, if any. This is read from
+// the unsigned data, falling back to the top-level prev_content used by older servers.
+func (event *Event) PreviousContent() map[string]interface{} {
+	var prevContent map[string]interface{}
+	if event.unmarshalUnsigned("prev_content", &prevContent) {
+		return prevContent
+	}
+	return event.PrevContent
+}
+
+// RelationChunk is a single aggregated relation, e.g a reaction key and how many times it has been used.
+type RelationChunk struct {
+	Type    string `json:"type,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Count   int    `json:"count,omitempty"`
+	EventID string `json:"event_id,omitempty"`
+}
+
+// ThreadSummary is the server-side aggregation of a thread.
+type ThreadSummary struct {
+	LatestEvent             *Event `json:"latest_event"`
+	Count                   int    `json:"count"`
+	CurrentUserParticipated bool   `json:"current_user_participated"`
+}
+
+// Relations are the aggregations of events which relate to an event, from the m.relations key of the unsigned data.
+type Relations struct {
+	Annotations *struct {
+		Chunk []RelationChunk `json:"chunk"`
+	} `json:"m.annotation,omitempty"`
+	References *struct {
+		Chunk []RelationChunk `json:"chunk"`
+	} `json:"m.reference,omitempty"`
+	Replace *Event         `json:"m.replace,omitempty"` // The most recent edit of the event
+	Thread  *ThreadSummary `json:"m.thread,omitempty"`
+}
+
+// Relations returns the aggregated relations of the event, or nil if there are none.
+func (event *Event) Relations() *Relations {
+	var relations Relations
+	if !event.unmarshalUnsigned("m.relations", &relations) {
+		return nil
+	}
+	return &relations
 }
 
 // Body returns the value of the "body" key in the event content if it is
@@ -29,6 +185,15 @@ func (event *Event) Body() (body string, ok bool) {
 	return
 }
 
+// ParseContent unmarshals the event content into the given struct, e.g one of the *Content types.
+func (event *Event) ParseContent(out interface{}) error {
+	b, err := json.Marshal(event.Content)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
 // MessageType returns the value of the "msgtype" key in the event content if
 // it is present and is a string.
 func (event *Event) MessageType() (msgtype string, ok bool) {
@@ -40,12 +205,30 @@ func (event *Event) MessageType() (msgtype string, ok bool) {
 	return
 }
 
+// FormattedBody returns the value of the "formatted_body" key in the event content, sanitized with SanitizeHTML,
+// if it is present and the "format" is HTML.
+func (event *Event) FormattedBody() (formattedBody string, ok bool) {
+	if format, _ := event.Content["format"].(string); format != "org.coddy.custom.html" {
+		return
+	}
+	value, exists := event.Content["formatted_body"]
+	if !exists {
+		return
+	}
+	formattedBody, ok = value.(string)
+	if ok {
+		formattedBody = SanitizeHTML(formattedBody)
+	}
+	return
+}
+
 // TextMessage is the contents of a Coddy formated message event.
 type TextMessage struct {
-	MsgType       string `json:"msgtype"`
-	Body          string `json:"body"`
-	FormattedBody string `json:"formatted_body"`
-	Format        string `json:"format"`
+	MsgType       string    `json:"msgtype"`
+	Body          string    `json:"body"`
+	FormattedBody string    `json:"formatted_body,omitempty"`
+	Format        string    `json:"format,omitempty"`
+	Mentions      *Mentions `json:"m.mentions,omitempty"`
 }
 
 // ThumbnailInfo contains info about an thumbnail image - m-image
@@ -95,10 +278,11 @@ type ImageMessage struct {
 
 // An HTMLMessage is the contents of a Coddy HTML formated message event.
 type HTMLMessage struct {
-	Body          string `json:"body"`
-	MsgType       string `json:"msgtype"`
-	Format        string `json:"format"`
-	FormattedBody string `json:"formatted_body"`
+	Body          string    `json:"body"`
+	MsgType       string    `json:"msgtype"`
+	Format        string    `json:"format"`
+	FormattedBody string    `json:"formatted_body"`
+	Mentions      *Mentions `json:"m.mentions,omitempty"`
 }
 
 // FileInfo contains info about an file - m-file
@@ -142,13 +326,11 @@ type AudioMessage struct {
 	Info    AudioInfo `json:"info,omitempty"`
 }
 
-var htmlRegex = regexp.MustCompile("<[^<]+?>")
-
-// GetHTMLMessage returns an HTMLMessage with the body set to a stripped version of the provided HTML, in addition
-// to the provided HTML.
+// GetHTMLMessage returns an HTMLMessage with the body set to a plain text version of the provided HTML, in addition
+// to the provided HTML. See HTMLToText.
 func GetHTMLMessage(msgtype, htmlText string) HTMLMessage {
 	return HTMLMessage{
-		Body:          html.UnescapeString(htmlRegex.ReplaceAllLiteralString(htmlText, "")),
+		Body:          HTMLToText(htmlText),
 		MsgType:       msgtype,
 		Format:        "org.coddy.custom.html",
 		FormattedBody: htmlText,
@@ -33,6 +33,14 @@ type FilterPart struct {
 	Senders     []string `json:"senders,omitempty"`
 	Types       []string `json:"types,omitempty"`
 	ContainsURL *bool    `json:"contains_url,omitempty"`
+
+	// Only send the member events needed to display the senders of the events in the response. Only used by
+	// the state and timeline filters. The full member list can be fetched with Client.LoadMembers.
+	LazyLoadMembers bool `json:"lazy_load_members,omitempty"`
+	// Send member events even if this client was already sent them. Only used with LazyLoadMembers.
+	IncludeRedundantMembers bool `json:"include_redundant_members,omitempty"`
+	// Send unread notification counts for each thread separately. Only used by the timeline filter.
+	UnreadThreadNotifications bool `json:"unread_thread_notifications,omitempty"`
 }
 
 // Validate checks if the filter contains valid property values
@@ -1,11 +1,37 @@
 package xcore
 
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
 // Frame represents a single Coddy frame.
+//
+// The state of the frame is safe to read from any goroutine while it is being updated by the syncing
+// goroutine. Updates are copy-on-write: each update replaces the current FrameState with a new one, so readers
+// never block the sync loop and never see a partially applied update.
 type Frame struct {
-	ID    string
-	State map[string]map[string]*Event
+	ID string
+
+	state    atomic.Pointer[FrameState]
+	writeMu  sync.Mutex // serialises updates to state
+	timeline Timeline
+
+	membersLoaded atomic.Bool
+	counts        frameCounts
+}
+
+// FrameState is an immutable snapshot of the state of a frame at a point in time.
+//
+// The events returned by a FrameState are shared between snapshots and must not be modified.
+type FrameState struct {
+	events map[string]map[string]*Event // event type to state key to event
 }
 
+// emptyFrameState is the state of a frame with no state events.
+var emptyFrameState = &FrameState{events: map[string]map[string]*Event{}}
+
 // PublicFrame represents the information about a public frame obtainable from the frame directory
 type PublicFrame struct {
 	CanonicalAlias   string   `json:"canonical_alias"`
@@ -14,33 +40,104 @@ type PublicFrame struct {
 	Topic            string   `json:"topic"`
 	NumJoinedMembers int      `json:"num_joined_members"`
 	AvatarURL        string   `json:"avatar_url"`
-	FrameID           string   `json:"frame_id"`
+	FrameID          string   `json:"frame_id"`
 	GuestCanJoin     bool     `json:"guest_can_join"`
 	Aliases          []string `json:"aliases"`
 }
 
-// UpdateState updates the frame's current state with the given Event. This will clobber events based
-// on the type/state_key combination.
-func (frame Frame) UpdateState(event *Event) {
-	_, exists := frame.State[event.Type]
-	if !exists {
-		frame.State[event.Type] = make(map[string]*Event)
+// Snapshot returns the current state of the frame. The snapshot does not change when the frame is updated.
+func (frame *Frame) Snapshot() *FrameState {
+	if state := frame.state.Load(); state != nil {
+		return state
+	}
+	return emptyFrameState
+}
+
+// UpdateState updates the frame's current state with the given Events. This will clobber events based
+// on the type/state_key combination. Events without a state key are ignored.
+//
+// The events are copied, so the caller may reuse them afterwards. All the events are applied in a single
+// update, so readers either see all of them or none of them.
+func (frame *Frame) UpdateState(events ...*Event) {
+	frame.modifyState(func(state map[string]map[string]*Event, copyType func(eventType string)) {
+		for _, event := range events {
+			if event.StateKey == nil {
+				continue
+			}
+			copyType(event.Type)
+			ev := *event
+			state[event.Type][*event.StateKey] = &ev
+		}
+	})
+}
+
+// modifyState applies fn to a copy of the current state and then makes it the current state. fn must call
+// copyType before modifying the state keys of an event type, so that maps shared with older snapshots
+// are never modified.
+func (frame *Frame) modifyState(fn func(state map[string]map[string]*Event, copyType func(eventType string))) {
+	frame.writeMu.Lock()
+	defer frame.writeMu.Unlock()
+
+	old := frame.Snapshot().events
+	state := make(map[string]map[string]*Event, len(old))
+	for eventType, stateKeys := range old {
+		state[eventType] = stateKeys
+	}
+	copied := make(map[string]bool)
+	copyType := func(eventType string) {
+		if copied[eventType] {
+			return
+		}
+		stateKeys := make(map[string]*Event, len(old[eventType])+1)
+		for stateKey, event := range old[eventType] {
+			stateKeys[stateKey] = event
+		}
+		state[eventType] = stateKeys
+		copied[eventType] = true
+	}
+	fn(state, copyType)
+	frame.state.Store(&FrameState{events: state})
+}
+
+// State returns a copy of the current state of the frame, as a map of event type to state key to event.
+// Modifying the returned maps doesn't change the frame; use UpdateState for that. The events are shallow copies,
+// so their content must not be modified.
+//
+// This replaces the State field which Frame used to have. Prefer Snapshot, which doesn't copy the state.
+func (frame *Frame) State() map[string]map[string]*Event {
+	events := frame.Snapshot().events
+	state := make(map[string]map[string]*Event, len(events))
+	for eventType, stateKeys := range events {
+		state[eventType] = make(map[string]*Event, len(stateKeys))
+		for stateKey, event := range stateKeys {
+			ev := *event
+			state[eventType][stateKey] = &ev
+		}
 	}
-	frame.State[event.Type][*event.StateKey] = event
+	return state
 }
 
 // GetStateEvent returns the state event for the given type/state_key combo, or nil.
-func (frame Frame) GetStateEvent(eventType string, stateKey string) *Event {
-	stateEventMap := frame.State[eventType]
-	event := stateEventMap[stateKey]
-	return event
+func (frame *Frame) GetStateEvent(eventType string, stateKey string) *Event {
+	return frame.Snapshot().GetStateEvent(eventType, stateKey)
 }
 
 // GetMembershipState returns the membership state of the given user ID in this frame. If there is
 // no entry for this member, 'leave' is returned for consistency with left users.
-func (frame Frame) GetMembershipState(userID string) string {
+func (frame *Frame) GetMembershipState(userID string) string {
+	return frame.Snapshot().GetMembershipState(userID)
+}
+
+// GetStateEvent returns the state event for the given type/state_key combo, or nil.
+func (s *FrameState) GetStateEvent(eventType string, stateKey string) *Event {
+	return s.events[eventType][stateKey]
+}
+
+// GetMembershipState returns the membership state of the given user ID. If there is
+// no entry for this member, 'leave' is returned for consistency with left users.
+func (s *FrameState) GetMembershipState(userID string) string {
 	state := "leave"
-	event := frame.GetStateEvent("m.frame.member", userID)
+	event := s.GetStateEvent("m.frame.member", userID)
 	if event != nil {
 		membershipState, found := event.Content["membership"]
 		if found {
@@ -53,11 +150,43 @@ func (frame Frame) GetMembershipState(userID string) string {
 	return state
 }
 
+// StateKeys returns the state keys of the state events with the given type, in sorted order.
+func (s *FrameState) StateKeys(eventType string) []string {
+	keys := make([]string, 0, len(s.events[eventType]))
+	for stateKey := range s.events[eventType] {
+		keys = append(keys, stateKey)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// EventsOfType returns the state events with the given type, sorted by state key.
+func (s *FrameState) EventsOfType(eventType string) []*Event {
+	keys := s.StateKeys(eventType)
+	events := make([]*Event, len(keys))
+	for i, stateKey := range keys {
+		events[i] = s.events[eventType][stateKey]
+	}
+	return events
+}
+
+// Events returns all the state events, sorted by type and then state key.
+func (s *FrameState) Events() []*Event {
+	types := make([]string, 0, len(s.events))
+	for eventType := range s.events {
+		types = append(types, eventType)
+	}
+	sort.Strings(types)
+	var events []*Event
+	for _, eventType := range types {
+		events = append(events, s.EventsOfType(eventType)...)
+	}
+	return events
+}
+
 // NewFrame creates a new Frame with the given ID
 func NewFrame(frameID string) *Frame {
-	// Init the State map and return a pointer to the Frame
 	return &Frame{
-		ID:    frameID,
-		State: make(map[string]map[string]*Event),
+		ID: frameID,
 	}
 }
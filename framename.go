@@ -0,0 +1,131 @@
+package xcore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxFrameHeroes is the maximum number of members used to name a frame which has no name or canonical alias.
+const MaxFrameHeroes = 5
+
+// DisplayName calculates the name of the frame as seen by the given user: the m.frame.name if set, then the
+// canonical alias, then the names of other members of the frame, e.g "Alice, Bob and 3 others". Frames with no
+// other members are named "Empty frame", or "Empty frame (was Alice and Bob)" if other members have left.
+func (s *FrameState) DisplayName(ownUserID string) string {
+	if name := s.stringContent("m.frame.name", "", "name"); name != "" {
+		return name
+	}
+	if alias := s.stringContent("m.frame.canonical_alias", "", "alias"); alias != "" {
+		return alias
+	}
+
+	var heroes, formerHeroes []string
+	count := 0
+	for _, userID := range s.StateKeys("m.frame.member") {
+		if userID == ownUserID {
+			continue
+		}
+		switch s.GetMembershipState(userID) {
+		case "join", "invite":
+			count++
+			heroes = append(heroes, userID)
+		case "leave", "ban":
+			formerHeroes = append(formerHeroes, userID)
+		}
+	}
+	if count == 0 {
+		if len(formerHeroes) == 0 {
+			return "Empty frame"
+		}
+		return fmt.Sprintf("Empty frame (was %s)", s.heroNames(formerHeroes, len(formerHeroes)))
+	}
+	return s.heroNames(heroes, count)
+}
+
+// heroNames joins the display names of the first MaxFrameHeroes heroes, where count is the total number of
+// members the heroes were taken from.
+func (s *FrameState) heroNames(heroes []string, count int) string {
+	if len(heroes) > MaxFrameHeroes {
+		heroes = heroes[:MaxFrameHeroes]
+	}
+	names := make([]string, len(heroes))
+	for i, userID := range heroes {
+		names[i] = s.MemberDisplayName(userID)
+	}
+	if others := count - len(names); others > 0 {
+		if others == 1 {
+			return strings.Join(names, ", ") + " and 1 other"
+		}
+		return fmt.Sprintf("%s and %d others", strings.Join(names, ", "), others)
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// MemberDisplayName returns the name to show for the given user: their display name in the frame, followed by
+// their user ID if another joined or invited member has the same display name. Users without a display name are
+// shown by their user ID.
+func (s *FrameState) MemberDisplayName(userID string) string {
+	name := s.stringContent("m.frame.member", userID, "displayname")
+	if name == "" {
+		return userID
+	}
+	for _, other := range s.StateKeys("m.frame.member") {
+		if other == userID {
+			continue
+		}
+		membership := s.GetMembershipState(other)
+		if membership != "join" && membership != "invite" {
+			continue
+		}
+		if s.stringContent("m.frame.member", other, "displayname") == name {
+			return fmt.Sprintf("%s (%s)", name, userID)
+		}
+	}
+	return name
+}
+
+// stringContent returns the string value of the given content key of a state event, or "" if the event or key
+// is missing or the value isn't a string.
+func (s *FrameState) stringContent(eventType, stateKey, key string) string {
+	event := s.GetStateEvent(eventType, stateKey)
+	if event == nil {
+		return ""
+	}
+	value, _ := event.Content[key].(string)
+	return value
+}
+
+// DisplayName calculates the current name of the frame as seen by the given user. See FrameState.DisplayName.
+//
+// If the frame has no name or canonical alias and /sync sent a frame summary, the heroes and member counts of the
+// summary are used, so that frames are named correctly when members are lazy-loaded.
+func (frame *Frame) DisplayName(ownUserID string) string {
+	state := frame.Snapshot()
+	counts := frame.Counts()
+	if len(counts.Heroes) == 0 || state.stringContent("m.frame.name", "", "name") != "" ||
+		state.stringContent("m.frame.canonical_alias", "", "alias") != "" {
+		return state.DisplayName(ownUserID)
+	}
+	var heroes []string
+	for _, userID := range counts.Heroes {
+		if userID != ownUserID {
+			heroes = append(heroes, userID)
+		}
+	}
+	count := counts.JoinedMemberCount + counts.InvitedMemberCount - 1
+	if count <= 0 {
+		if len(heroes) == 0 {
+			return "Empty frame"
+		}
+		return fmt.Sprintf("Empty frame (was %s)", state.heroNames(heroes, len(heroes)))
+	}
+	return state.heroNames(heroes, count)
+}
+
+// MemberDisplayName returns the name to show for the given member of the frame. See FrameState.MemberDisplayName.
+func (frame *Frame) MemberDisplayName(userID string) string {
+	return frame.Snapshot().MemberDisplayName(userID)
+}
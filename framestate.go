@@ -0,0 +1,121 @@
+package xcore
+
+import (
+	"fmt"
+	"sort"
+)
+
+// GetFrameState returns the current state events of the frame. See get-coddy-client-r0-frames-frameid-state
+func (cli *Client) GetFrameState(frameID string) (resp []Event, err error) {
+	urlPath := cli.BuildURL("frames", frameID, "state")
+	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// RefreshFrame replaces the state of the frame in the store with its current state on the server, creating the
+// frame in the store if it isn't there. The timeline and counts of an existing frame are kept.
+func (cli *Client) RefreshFrame(frameID string) (*Frame, error) {
+	events, err := cli.GetFrameState(frameID)
+	if err != nil {
+		return nil, err
+	}
+	frame := cli.Store.LoadFrame(frameID)
+	if frame == nil {
+		frame = NewFrame(frameID)
+		cli.Store.SaveFrame(frame)
+	}
+	for i := range events {
+		events[i].FrameID = frameID
+	}
+	frame.replaceState(events)
+	return frame, nil
+}
+
+// replaceState makes the given state events the whole state of the frame. The full state includes all the
+// members, so they are marked as loaded.
+func (frame *Frame) replaceState(events []Event) {
+	frame.modifyState(func(state map[string]map[string]*Event, copyType func(eventType string)) {
+		for eventType := range state {
+			delete(state, eventType)
+		}
+		for i := range events {
+			event := events[i]
+			if event.StateKey == nil {
+				continue
+			}
+			if state[event.Type] == nil {
+				state[event.Type] = make(map[string]*Event)
+			}
+			state[event.Type][*event.StateKey] = &event
+		}
+	})
+	frame.membersLoaded.Store(true)
+}
+
+// StateDrift is a difference between the cached state of a frame and its state on the server. Cached is nil if
+// the event is missing from the cache, and Server is nil if the server no longer has the event in the state.
+type StateDrift struct {
+	EventType string
+	StateKey  string
+	Cached    *Event
+	Server    *Event
+}
+
+func (d StateDrift) String() string {
+	switch {
+	case d.Cached == nil:
+		return fmt.Sprintf("%s (%q): missing from cache, server has %s", d.EventType, d.StateKey, d.Server.ID)
+	case d.Server == nil:
+		return fmt.Sprintf("%s (%q): cache has %s, not in server state", d.EventType, d.StateKey, d.Cached.ID)
+	}
+	return fmt.Sprintf("%s (%q): cache has %s, server has %s", d.EventType, d.StateKey, d.Cached.ID, d.Server.ID)
+}
+
+// CheckFrameState compares the state of the frame in the store with its state on the server, returning the
+// differences sorted by event type and state key. Events are compared by event ID. A frame which isn't in the
+// store has an empty cached state.
+//
+// Frames synced with lazy-loaded members are missing most member events until Client.LoadMembers is called,
+// which is reported as drift.
+func (cli *Client) CheckFrameState(frameID string) ([]StateDrift, error) {
+	events, err := cli.GetFrameState(frameID)
+	if err != nil {
+		return nil, err
+	}
+	cached := emptyFrameState
+	if frame := cli.Store.LoadFrame(frameID); frame != nil {
+		cached = frame.Snapshot()
+	}
+	server := &Frame{ID: frameID}
+	server.replaceState(events)
+	return diffState(cached, server.Snapshot()), nil
+}
+
+// diffState returns the state events which differ between the cached and server states, sorted by event type
+// and state key.
+func diffState(cached, server *FrameState) []StateDrift {
+	keys := make(map[StateKeyTuple]bool)
+	for _, state := range []*FrameState{cached, server} {
+		for eventType, stateKeys := range state.events {
+			for stateKey := range stateKeys {
+				keys[StateKeyTuple{eventType, stateKey}] = true
+			}
+		}
+	}
+	var drift []StateDrift
+	for key := range keys {
+		c := cached.GetStateEvent(key.EventType, key.StateKey)
+		s := server.GetStateEvent(key.EventType, key.StateKey)
+		if c != nil && s != nil && c.ID == s.ID {
+			continue
+		}
+		drift = append(drift, StateDrift{EventType: key.EventType, StateKey: key.StateKey, Cached: c, Server: s})
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].EventType != drift[j].EventType {
+			return drift[i].EventType < drift[j].EventType
+		}
+		return drift[i].StateKey < drift[j].StateKey
+	})
+	return drift
+}
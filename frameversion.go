@@ -0,0 +1,101 @@
+package xcore
+
+import "fmt"
+
+// EventIDFormat is the way event IDs are determined in a frame version.
+type EventIDFormat int
+
+const (
+	// EventIDFormatV1 event IDs are chosen by the origin server and sent in the event_id field of the PDU.
+	EventIDFormatV1 EventIDFormat = iota + 1
+	// EventIDFormatV3 event IDs are "$" followed by the standard unpadded base64 of the reference hash.
+	EventIDFormatV3
+	// EventIDFormatV4 event IDs are "$" followed by the URL-safe unpadded base64 of the reference hash.
+	EventIDFormatV4
+)
+
+// FrameVersionRules describes the behaviour which varies between frame versions.
+type FrameVersionRules struct {
+	Version       string
+	EventIDFormat EventIDFormat
+	StateResV2    bool // whether conflicts in state are resolved with version 2 of the state resolution algorithm
+
+	// Redaction algorithm differences.
+	RedactKeepsAliases           bool // m.frame.aliases keeps "aliases" (v1-5)
+	RedactKeepsJoinRulesAllow    bool // m.frame.join_rules keeps "allow" (v8+)
+	RedactKeepsJoinAuthorisedVia bool // m.frame.member keeps "join_authorised_via_users_server" (v9+)
+	RedactionRulesV11            bool // the redaction changes in v11, e.g keeping all of m.frame.create
+
+	// Authorization rule differences.
+	AuthAliasesSpecialCase       bool // m.frame.aliases events are allowed if the state key is the sender's server (v1-5)
+	AuthRedactionEventIDDomain   bool // redactions are allowed if the event IDs have the same server (v1-2)
+	AuthCreateRequiresCreator    bool // m.frame.create must have a "creator", which is the frame creator (v1-10)
+	AuthNotificationsPowerLevels bool // changes to "notifications" power levels are checked (v6+)
+	AuthIntegerPowerLevels       bool // power levels must be integers rather than strings (v10+)
+	AllowKnock                   bool // the knock join rule and membership (v7+)
+	AllowRestricted              bool // the restricted join rule (v8+)
+	AllowKnockRestricted         bool // the knock_restricted join rule (v10+)
+}
+
+// frameVersions are the known frame versions, keyed by version string.
+var frameVersions = map[string]FrameVersionRules{
+	"1": {
+		Version: "1", EventIDFormat: EventIDFormatV1,
+		RedactKeepsAliases: true, AuthAliasesSpecialCase: true, AuthRedactionEventIDDomain: true, AuthCreateRequiresCreator: true,
+	},
+	"2": {
+		Version: "2", EventIDFormat: EventIDFormatV1, StateResV2: true,
+		RedactKeepsAliases: true, AuthAliasesSpecialCase: true, AuthRedactionEventIDDomain: true, AuthCreateRequiresCreator: true,
+	},
+	"3": {
+		Version: "3", EventIDFormat: EventIDFormatV3, StateResV2: true,
+		RedactKeepsAliases: true, AuthAliasesSpecialCase: true, AuthCreateRequiresCreator: true,
+	},
+	"4": {
+		Version: "4", EventIDFormat: EventIDFormatV4, StateResV2: true,
+		RedactKeepsAliases: true, AuthAliasesSpecialCase: true, AuthCreateRequiresCreator: true,
+	},
+	"5": {
+		Version: "5", EventIDFormat: EventIDFormatV4, StateResV2: true,
+		RedactKeepsAliases: true, AuthAliasesSpecialCase: true, AuthCreateRequiresCreator: true,
+	},
+	"6": {
+		Version: "6", EventIDFormat: EventIDFormatV4, StateResV2: true,
+		AuthNotificationsPowerLevels: true, AuthCreateRequiresCreator: true,
+	},
+	"7": {
+		Version: "7", EventIDFormat: EventIDFormatV4, StateResV2: true,
+		AuthNotificationsPowerLevels: true, AuthCreateRequiresCreator: true, AllowKnock: true,
+	},
+	"8": {
+		Version: "8", EventIDFormat: EventIDFormatV4, StateResV2: true,
+		RedactKeepsJoinRulesAllow: true, AuthNotificationsPowerLevels: true, AuthCreateRequiresCreator: true,
+		AllowKnock: true, AllowRestricted: true,
+	},
+	"9": {
+		Version: "9", EventIDFormat: EventIDFormatV4, StateResV2: true,
+		RedactKeepsJoinRulesAllow: true, RedactKeepsJoinAuthorisedVia: true,
+		AuthNotificationsPowerLevels: true, AuthCreateRequiresCreator: true, AllowKnock: true, AllowRestricted: true,
+	},
+	"10": {
+		Version: "10", EventIDFormat: EventIDFormatV4, StateResV2: true,
+		RedactKeepsJoinRulesAllow: true, RedactKeepsJoinAuthorisedVia: true,
+		AuthNotificationsPowerLevels: true, AuthCreateRequiresCreator: true, AllowKnock: true, AllowRestricted: true,
+		AllowKnockRestricted: true, AuthIntegerPowerLevels: true,
+	},
+	"11": {
+		Version: "11", EventIDFormat: EventIDFormatV4, StateResV2: true,
+		RedactKeepsJoinRulesAllow: true, RedactKeepsJoinAuthorisedVia: true, RedactionRulesV11: true,
+		AuthNotificationsPowerLevels: true, AllowKnock: true, AllowRestricted: true,
+		AllowKnockRestricted: true, AuthIntegerPowerLevels: true,
+	},
+}
+
+// GetFrameVersionRules returns the rules for the given frame version, or an error if the version is unknown.
+func GetFrameVersionRules(frameVersion string) (FrameVersionRules, error) {
+	rules, ok := frameVersions[frameVersion]
+	if !ok {
+		return FrameVersionRules{}, fmt.Errorf("unknown frame version %q", frameVersion)
+	}
+	return rules, nil
+}
@@ -1,3 +1,7 @@
 module github.com/withqb/xcore
 
 go 1.21
+
+require github.com/yuin/goldmark v1.7.8
+
+require golang.org/x/net v0.30.0
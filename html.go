@@ -0,0 +1,432 @@
+package xcore
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxHTMLNesting is the maximum depth of nested tags kept by SanitizeHTML. Tags nested any deeper are dropped.
+const maxHTMLNesting = 100
+
+// allowedHTMLTags lists the tags which may appear in formatted_body, along with the attributes allowed on each.
+var allowedHTMLTags = map[string][]string{
+	"font":       {"data-mx-bg-color", "data-mx-color", "color"},
+	"del":        nil,
+	"s":          nil,
+	"strike":     nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"blockquote": nil,
+	"p":          nil,
+	"a":          {"name", "target", "href"},
+	"ul":         nil,
+	"ol":         {"start"},
+	"sup":        nil,
+	"sub":        nil,
+	"li":         nil,
+	"b":          nil,
+	"i":          nil,
+	"u":          nil,
+	"strong":     nil,
+	"em":         nil,
+	"code":       {"class"},
+	"hr":         nil,
+	"br":         nil,
+	"div":        {"data-mx-maths"},
+	"table":      nil,
+	"thead":      nil,
+	"tbody":      nil,
+	"tr":         nil,
+	"th":         nil,
+	"td":         nil,
+	"caption":    nil,
+	"pre":        nil,
+	"span":       {"data-mx-bg-color", "data-mx-color", "data-mx-spoiler", "data-mx-maths"},
+	"img":        {"width", "height", "alt", "title", "src"},
+	"details":    nil,
+	"summary":    nil,
+	"mx-reply":   nil,
+}
+
+// droppedHTMLTags are removed along with everything inside them, rather than just having the tag stripped.
+var droppedHTMLTags = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"head":     true,
+	"title":    true,
+	"iframe":   true,
+	"object":   true,
+	"embed":    true,
+	"noscript": true,
+	"template": true,
+	"textarea": true,
+	"select":   true,
+	"svg":      true,
+	"math":     true,
+}
+
+// allowedLinkSchemes are the URL schemes which may be used in the href of a link.
+var allowedLinkSchemes = map[string]bool{
+	"https":  true,
+	"http":   true,
+	"ftp":    true,
+	"mailto": true,
+	"magnet": true,
+}
+
+var (
+	htmlColorRegex     = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	codeLanguageRegex  = regexp.MustCompile(`^language-[a-zA-Z0-9_+#.-]+$`)
+	htmlDimensionRegex = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// sanitizeAttribute returns the value to use for the given attribute, or false if it should be dropped.
+func sanitizeAttribute(tag, key, val string) (string, bool) {
+	switch key {
+	case "color", "data-mx-color", "data-mx-bg-color":
+		return val, htmlColorRegex.MatchString(val)
+	case "href":
+		u, err := url.Parse(val)
+		if err != nil {
+			return "", false
+		}
+		return val, allowedLinkSchemes[strings.ToLower(u.Scheme)]
+	case "src":
+		return val, strings.HasPrefix(val, "mxc://")
+	case "class":
+		return val, tag == "code" && codeLanguageRegex.MatchString(val)
+	case "start", "width", "height":
+		return val, htmlDimensionRegex.MatchString(val)
+	}
+	return val, true
+}
+
+// SanitizeHTML restricts the given HTML to the subset which may be used in the formatted_body of a message.
+//
+// Tags which aren't allowed are stripped but their contents are kept, except for tags such as <script> whose
+// contents are dropped entirely. Attributes which aren't allowed on a tag are removed, links may only use
+// http(s), ftp, mailto and magnet URLs and images may only use mxc:// URIs. The output is always well formed:
+// stray closing tags are removed and unclosed tags are closed.
+func SanitizeHTML(htmlText string) string {
+	var out strings.Builder
+	var open []string // stack of open allowed tags
+	var skipTag string
+	skipDepth := 0
+	tooDeep := make(map[string]int) // tags dropped for being nested too deeply, whose end tags must be dropped too
+
+	z := html.NewTokenizer(strings.NewReader(htmlText))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			// io.EOF, or the input couldn't be tokenized any further
+			break
+		}
+		token := z.Token()
+		if skipDepth > 0 {
+			switch {
+			case tt == html.StartTagToken && token.Data == skipTag:
+				skipDepth++
+			case tt == html.EndTagToken && token.Data == skipTag:
+				skipDepth--
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			out.WriteString(html.EscapeString(token.Data))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedHTMLTags[token.Data] {
+				if tt == html.StartTagToken {
+					skipTag = token.Data
+					skipDepth = 1
+				}
+				continue
+			}
+			allowedAttrs, allowed := allowedHTMLTags[token.Data]
+			if !allowed {
+				continue
+			}
+			if len(open) >= maxHTMLNesting {
+				if tt == html.StartTagToken && !isVoidHTMLTag(token.DataAtom) {
+					tooDeep[token.Data]++
+				}
+				continue
+			}
+			if token.DataAtom == atom.Img && !hasValidImageSource(token) {
+				continue
+			}
+			out.WriteString("<" + token.Data)
+			for _, attr := range token.Attr {
+				if attr.Namespace != "" || !containsString(allowedAttrs, attr.Key) {
+					continue
+				}
+				val, ok := sanitizeAttribute(token.Data, attr.Key, attr.Val)
+				if !ok {
+					continue
+				}
+				out.WriteString(" " + attr.Key + `="` + html.EscapeString(val) + `"`)
+			}
+			out.WriteString(">")
+			if isVoidHTMLTag(token.DataAtom) {
+				continue
+			}
+			if tt == html.SelfClosingTagToken {
+				out.WriteString("</" + token.Data + ">")
+				continue
+			}
+			open = append(open, token.Data)
+		case html.EndTagToken:
+			if tooDeep[token.Data] > 0 {
+				tooDeep[token.Data]--
+				continue
+			}
+			// Close everything up to and including the matching open tag, if there is one.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != token.Data {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					out.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+	return out.String()
+}
+
+func hasValidImageSource(token html.Token) bool {
+	for _, attr := range token.Attr {
+		if attr.Key == "src" {
+			return strings.HasPrefix(attr.Val, "mxc://")
+		}
+	}
+	return false
+}
+
+func isVoidHTMLTag(a atom.Atom) bool {
+	return a == atom.Br || a == atom.Hr || a == atom.Img
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// HTMLToText converts the HTML of a formatted_body into readable plain text.
+//
+// Block elements are placed on their own lines, list items are prefixed with bullets or numbers, quotes are
+// prefixed with "> " and links are written as "text (URL)" unless they are pills, which are written as
+// their text. Reply fallbacks in <mx-reply> are removed.
+func HTMLToText(htmlText string) string {
+	context := &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := html.ParseFragment(strings.NewReader(htmlText), context)
+	if err != nil {
+		return html.UnescapeString(htmlText)
+	}
+	var w htmlTextWriter
+	for _, n := range nodes {
+		w.writeNode(n, false)
+	}
+	return w.result()
+}
+
+// htmlTextWriter builds up the plain text version of some HTML.
+type htmlTextWriter struct {
+	strings.Builder
+	pendingBreak int // number of newlines which must precede the next text
+}
+
+func (w *htmlTextWriter) result() string {
+	return strings.Trim(w.String(), "\n")
+}
+
+// text writes inline text, starting a new line first if a block element has just ended.
+func (w *htmlTextWriter) text(s string) {
+	w.write(s, false)
+}
+
+// write writes text, starting a new line first if a block element has just ended. Spaces at the start of a line
+// are trimmed unless the text is preformatted.
+func (w *htmlTextWriter) write(s string, pre bool) {
+	if s == "" {
+		return
+	}
+	if w.pendingBreak > 0 && w.Len() > 0 {
+		if !pre {
+			s = strings.TrimLeft(s, " ")
+		}
+		if s == "" {
+			return
+		}
+		current := w.String()
+		w.Reset()
+		w.WriteString(strings.TrimRight(current, " "))
+		for i := 0; i < w.pendingBreak; i++ {
+			w.WriteString("\n")
+		}
+	} else if !pre && (w.Len() == 0 || strings.HasSuffix(w.String(), "\n")) {
+		s = strings.TrimLeft(s, " ")
+	}
+	w.pendingBreak = 0
+	w.WriteString(s)
+}
+
+// block writes already rendered text as a block, separated from its surroundings by the given number of newlines.
+func (w *htmlTextWriter) block(s string, newlines int) {
+	w.writeBlock(s, newlines, false)
+}
+
+// writeBlock writes a block like block, keeping the spaces at the start of its lines if it is preformatted.
+func (w *htmlTextWriter) writeBlock(s string, newlines int, pre bool) {
+	if w.pendingBreak < newlines {
+		w.pendingBreak = newlines
+	}
+	if s != "" {
+		w.write(s, pre)
+	}
+	if w.pendingBreak < newlines {
+		w.pendingBreak = newlines
+	}
+}
+
+// children renders the children of the node into a new writer and returns the text.
+func (w *htmlTextWriter) children(n *html.Node, pre bool) string {
+	var inner htmlTextWriter
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		inner.writeNode(c, pre)
+	}
+	return inner.result()
+}
+
+var htmlWhitespaceRegex = regexp.MustCompile(`[ \t\r\n\f]+`)
+
+func (w *htmlTextWriter) writeNode(n *html.Node, pre bool) {
+	switch n.Type {
+	case html.TextNode:
+		if pre {
+			w.write(n.Data, true)
+		} else {
+			w.text(htmlWhitespaceRegex.ReplaceAllString(n.Data, " "))
+		}
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.Data {
+	case "mx-reply", "script", "style", "head", "title":
+		// reply fallbacks and non-content elements are dropped
+	case "br":
+		w.WriteString("\n")
+		w.pendingBreak = 0
+	case "hr":
+		w.block("---", 1)
+	case "img":
+		w.text(htmlAttr(n, "alt"))
+	case "a":
+		text := w.children(n, pre)
+		href := htmlAttr(n, "href")
+		switch {
+		case href == "", text == href, strings.HasPrefix(href, PermalinkPrefix), "mailto:"+text == href:
+			w.text(text)
+		case text == "":
+			w.text(href)
+		default:
+			w.text(text + " (" + href + ")")
+		}
+	case "pre":
+		w.writeBlock(strings.TrimRight(w.children(n, true), "\n"), 2, true)
+	case "code":
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			w.writeNode(c, true)
+		}
+	case "p":
+		w.block(w.children(n, pre), 2)
+	case "blockquote":
+		lines := strings.Split(w.children(n, pre), "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight("> "+line, " ")
+		}
+		w.block(strings.Join(lines, "\n"), 2)
+	case "ul", "ol":
+		if n.Parent != nil && n.Parent.Data == "li" {
+			w.block(w.list(n, pre), 1) // nested lists follow on directly from the item
+		} else {
+			w.block(w.list(n, pre), 2)
+		}
+	case "tr":
+		var cells []string
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && (c.Data == "td" || c.Data == "th") {
+				cells = append(cells, w.children(c, pre))
+			}
+		}
+		w.block(strings.Join(cells, " | "), 1)
+	case "h1", "h2", "h3", "h4", "h5", "h6", "div", "table", "thead", "tbody", "caption", "details", "summary", "li":
+		w.block(w.children(n, pre), 1)
+	default:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			w.writeNode(c, pre)
+		}
+	}
+}
+
+// list renders the items of a <ul> or <ol>, indenting any continuation lines to line up with the item text.
+func (w *htmlTextWriter) list(n *html.Node, pre bool) string {
+	ordered := n.Data == "ol"
+	index := 1
+	if start, err := strconv.Atoi(htmlAttr(n, "start")); err == nil {
+		index = start
+	}
+	var items []string
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.Data != "li" {
+			continue
+		}
+		marker := "- "
+		if ordered {
+			marker = strconv.Itoa(index) + ". "
+			index++
+		}
+		lines := strings.Split(w.children(c, pre), "\n")
+		indent := strings.Repeat(" ", len(marker))
+		for i, line := range lines {
+			if i == 0 {
+				lines[i] = marker + line
+			} else if line != "" {
+				lines[i] = indent + line
+			}
+		}
+		items = append(items, strings.Join(lines, "\n"))
+	}
+	return strings.Join(items, "\n")
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,343 @@
+package xcore
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// PermalinkPrefix is the prefix used to build permalinks to users, frames and frame aliases. Links to these
+// permalinks in formatted_body are rendered as pills by clients.
+const PermalinkPrefix = "https://coddy.to/#/"
+
+// PermalinkURL returns the permalink for the given user ID, frame ID or frame alias.
+func PermalinkURL(id string) string {
+	return PermalinkPrefix + id
+}
+
+// isPillTarget returns true if the link destination is a user ID, frame ID or frame alias rather than a URL.
+func isPillTarget(dest string) bool {
+	if len(dest) < 2 || !strings.Contains(dest, ":") {
+		return false
+	}
+	switch dest[0] {
+	case '@', '!', '#':
+		return true
+	}
+	return false
+}
+
+// markdown is the CommonMark renderer used by RenderMarkdown. It renders only the subset of HTML which
+// clients are required to support: raw HTML in the input is escaped, images which aren't mxc:// URIs are
+// turned into links and link titles/table alignments are dropped.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.Strikethrough,
+		extension.Linkify,
+		extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignNone)),
+	),
+	goldmark.WithParserOptions(
+		parser.WithASTTransformers(util.Prioritized(markdownTransformer{}, 1000)),
+	),
+	goldmark.WithRendererOptions(
+		renderer.WithNodeRenderers(util.Prioritized(rawHTMLRenderer{}, 100)),
+	),
+)
+
+// markdownTransformer rewrites the parsed markdown so that it renders into the allowed HTML subset.
+type markdownTransformer struct{}
+
+// Transform implements parser.ASTTransformer
+func (markdownTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	var images []*ast.Image
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch node := n.(type) {
+		case *ast.Link:
+			node.Title = nil
+			if dest := string(node.Destination); isPillTarget(dest) {
+				node.Destination = []byte(PermalinkURL(dest))
+			}
+		case *ast.Image:
+			if !bytes.HasPrefix(node.Destination, []byte("mxc://")) {
+				images = append(images, node)
+			}
+			node.Title = nil
+		}
+		return ast.WalkContinue, nil
+	})
+	// Only mxc:// images may be inlined, so link to anything else instead.
+	for _, img := range images {
+		link := ast.NewLink()
+		link.Destination = img.Destination
+		for c := img.FirstChild(); c != nil; {
+			next := c.NextSibling()
+			link.AppendChild(link, c)
+			c = next
+		}
+		img.Parent().ReplaceChild(img.Parent(), img, link)
+	}
+}
+
+// rawHTMLRenderer renders any raw HTML in the markdown as escaped text.
+type rawHTMLRenderer struct{}
+
+// RegisterFuncs implements renderer.NodeRenderer
+func (r rawHTMLRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindRawHTML, r.renderRawHTML)
+	reg.Register(ast.KindHTMLBlock, r.renderHTMLBlock)
+}
+
+func (r rawHTMLRenderer) renderRawHTML(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		segments := n.(*ast.RawHTML).Segments
+		for i := 0; i < segments.Len(); i++ {
+			seg := segments.At(i)
+			_, _ = w.Write(util.EscapeHTML(seg.Value(source)))
+		}
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+func (r rawHTMLRenderer) renderHTMLBlock(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	block := n.(*ast.HTMLBlock)
+	_, _ = w.WriteString("<p>")
+	lines := block.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		_, _ = w.Write(util.EscapeHTML(line.Value(source)))
+	}
+	if block.HasClosure() {
+		_, _ = w.Write(util.EscapeHTML(block.ClosureLine.Value(source)))
+	}
+	_, _ = w.WriteString("</p>\n")
+	return ast.WalkContinue, nil
+}
+
+// RenderMarkdown renders the given CommonMark into the contents of an m.text message.
+//
+// The formatted_body is restricted to the HTML subset in the spec and the body is a plain text rendering of
+// the markdown, with links replaced by their text and URL. If the markdown contains no formatting at all,
+// a plain message without a formatted_body is returned.
+//
+// Links to user IDs, frame IDs and frame aliases are rendered as pills, and users linked to this way are
+// added to m.mentions, e.g:
+//
+//	[Alice](@alice:example.org) please review this
+//
+// Messages without user pills have no m.mentions, so receiving clients fall back to searching the body.
+func RenderMarkdown(md string) TextMessage {
+	source := []byte(md)
+	doc := markdown.Parser().Parse(text.NewReader(source))
+
+	var plain plainTextWriter
+	plain.writeBlocks(doc, source)
+	body := strings.TrimRight(plain.String(), "\n")
+	mentions := markdownMentions(doc)
+	if !hasFormatting(doc) {
+		return TextMessage{MsgType: "m.text", Body: body, Mentions: mentions}
+	}
+
+	var buf bytes.Buffer
+	if err := markdown.Renderer().Render(&buf, source, doc); err != nil {
+		// Rendering only fails if writing to the buffer fails.
+		return TextMessage{MsgType: "m.text", Body: body, Mentions: mentions}
+	}
+	formatted := strings.TrimRight(buf.String(), "\n")
+	// Clients render a lone paragraph as an inline message, so don't wrap it.
+	if doc.ChildCount() == 1 && doc.FirstChild().Kind() == ast.KindParagraph {
+		formatted = strings.TrimSuffix(strings.TrimPrefix(formatted, "<p>"), "</p>")
+	}
+	return TextMessage{
+		MsgType:       "m.text",
+		Body:          body,
+		FormattedBody: formatted,
+		Format:        "org.coddy.custom.html",
+		Mentions:      mentions,
+	}
+}
+
+// markdownMentions returns the users linked to with pills in the document, or nil if there are none, so that
+// messages without pills don't claim to mention nobody.
+func markdownMentions(doc ast.Node) *Mentions {
+	var mentions *Mentions
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if link, ok := n.(*ast.Link); ok && entering {
+			if id, ok := ParsePermalink(string(link.Destination)); ok && id[0] == '@' {
+				if mentions == nil {
+					mentions = &Mentions{}
+				}
+				mentions.AddUser(id)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	return mentions
+}
+
+// hasFormatting returns true if the document contains anything other than paragraphs of plain text.
+func hasFormatting(doc ast.Node) bool {
+	formatted := false
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		switch node := n.(type) {
+		case *ast.Document, *ast.Paragraph, *ast.String:
+		case *ast.Text:
+			if node.HardLineBreak() {
+				formatted = true
+			}
+		default:
+			formatted = true
+		}
+		if formatted {
+			return ast.WalkStop, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return formatted
+}
+
+// plainTextWriter renders a markdown AST as plain text suitable for the body of a message.
+type plainTextWriter struct {
+	strings.Builder
+}
+
+// writeBlocks writes each child block of the node, separated by blank lines.
+func (w *plainTextWriter) writeBlocks(n ast.Node, source []byte) {
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if c.PreviousSibling() != nil {
+			w.WriteString("\n")
+			if list, ok := n.(*ast.List); !ok || !list.IsTight {
+				w.WriteString("\n")
+			}
+		}
+		w.writeBlock(c, source)
+	}
+}
+
+func (w *plainTextWriter) writeBlock(n ast.Node, source []byte) {
+	switch node := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock, *ast.Heading:
+		w.writeInlines(node, source)
+	case *ast.ThematicBreak:
+		w.WriteString("---")
+	case *ast.CodeBlock, *ast.FencedCodeBlock, *ast.HTMLBlock:
+		lines := node.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			line := lines.At(i)
+			w.Write(line.Value(source))
+		}
+		if html, ok := node.(*ast.HTMLBlock); ok && html.HasClosure() {
+			w.Write(html.ClosureLine.Value(source))
+		}
+		w.trimNewlines()
+	case *ast.Blockquote:
+		var inner plainTextWriter
+		inner.writeBlocks(node, source)
+		for i, line := range strings.Split(inner.String(), "\n") {
+			if i > 0 {
+				w.WriteString("\n")
+			}
+			w.WriteString("> " + line)
+		}
+	case *ast.List:
+		start := node.Start
+		for item := node.FirstChild(); item != nil; item = item.NextSibling() {
+			if item.PreviousSibling() != nil {
+				w.WriteString("\n")
+				if !node.IsTight {
+					w.WriteString("\n")
+				}
+			}
+			marker := "- "
+			if node.IsOrdered() {
+				marker = strconv.Itoa(start) + ". "
+				start++
+			}
+			var inner plainTextWriter
+			inner.writeBlocks(item, source)
+			indent := strings.Repeat(" ", len(marker))
+			for i, line := range strings.Split(inner.String(), "\n") {
+				if i == 0 {
+					w.WriteString(marker + line)
+				} else if line == "" {
+					w.WriteString("\n")
+				} else {
+					w.WriteString("\n" + indent + line)
+				}
+			}
+		}
+	case *extast.Table:
+		for row := node.FirstChild(); row != nil; row = row.NextSibling() {
+			if row.PreviousSibling() != nil {
+				w.WriteString("\n")
+			}
+			for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+				if cell.PreviousSibling() != nil {
+					w.WriteString(" | ")
+				}
+				w.writeInlines(cell, source)
+			}
+		}
+	default:
+		w.writeBlocks(node, source)
+	}
+}
+
+func (w *plainTextWriter) writeInlines(n ast.Node, source []byte) {
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch node := c.(type) {
+		case *ast.Text:
+			value := node.Segment.Value(source)
+			if !node.IsRaw() {
+				// The body is plain text, so backslash escapes and entity references are written as the
+				// characters they stand for.
+				value = util.ResolveEntityNames(util.ResolveNumericReferences(util.UnescapePunctuations(value)))
+			}
+			w.Write(value)
+			if node.SoftLineBreak() || node.HardLineBreak() {
+				w.WriteString("\n")
+			}
+		case *ast.String:
+			w.Write(node.Value)
+		case *ast.RawHTML:
+			for i := 0; i < node.Segments.Len(); i++ {
+				seg := node.Segments.At(i)
+				w.Write(seg.Value(source))
+			}
+		case *ast.AutoLink:
+			w.Write(node.Label(source))
+		case *ast.Link:
+			var label plainTextWriter
+			label.writeInlines(node, source)
+			dest := string(node.Destination)
+			if strings.HasPrefix(dest, PermalinkPrefix) || label.String() == dest {
+				// pills are represented by their display text
+				w.WriteString(label.String())
+			} else {
+				w.WriteString(label.String() + " (" + dest + ")")
+			}
+		default:
+			w.writeInlines(node, source)
+		}
+	}
+}
+
+func (w *plainTextWriter) trimNewlines() {
+	s := strings.TrimRight(w.String(), "\n")
+	w.Reset()
+	w.WriteString(s)
+}
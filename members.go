@@ -0,0 +1,69 @@
+package xcore
+
+// Members returns the member events of the frame. at is a pagination token, e.g a next_batch from /sync, to get
+// the members at that point, or "" for the current members. membership and notMembership filter the members by
+// membership if they are not empty. See get-coddy-client-r0-frames-frameid-members
+func (cli *Client) Members(frameID, at, membership, notMembership string) (resp *RespMembers, err error) {
+	query := map[string]string{}
+	if at != "" {
+		query["at"] = at
+	}
+	if membership != "" {
+		query["membership"] = membership
+	}
+	if notMembership != "" {
+		query["not_membership"] = notMembership
+	}
+	urlPath := cli.BuildURLWithQuery([]string{"frames", frameID, "members"}, query)
+	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return
+}
+
+// LoadMembers fetches all the members of the frame and merges them into the state of the frame in the store,
+// for frames synced with a filter which lazy loads members. at is the next_batch of the sync the frame state is
+// from, e.g SyncIteration.Response.NextBatch, or "" for the current members. Members already in the state are
+// kept, as they are at least as recent.
+//
+// The token is passed in rather than loaded from the store, as stores may only be safe to read next batch
+// tokens from on the syncing goroutine.
+func (cli *Client) LoadMembers(frameID, at string) error {
+	resp, err := cli.Members(frameID, at, "", "")
+	if err != nil {
+		return err
+	}
+	frame := cli.Store.LoadFrame(frameID)
+	if frame == nil {
+		frame = NewFrame(frameID)
+		cli.Store.SaveFrame(frame)
+	}
+	for i := range resp.Chunk {
+		resp.Chunk[i].FrameID = frameID
+	}
+	frame.mergeMembers(resp.Chunk)
+	return nil
+}
+
+// mergeMembers adds the member events for users who don't already have a member event in the state, then marks
+// the members of the frame as loaded.
+func (frame *Frame) mergeMembers(events []Event) {
+	frame.modifyState(func(state map[string]map[string]*Event, copyType func(eventType string)) {
+		for i := range events {
+			event := events[i]
+			if event.Type != "m.frame.member" || event.StateKey == nil {
+				continue
+			}
+			if _, exists := state[event.Type][*event.StateKey]; exists {
+				continue
+			}
+			copyType(event.Type)
+			state[event.Type][*event.StateKey] = &event
+		}
+	})
+	frame.membersLoaded.Store(true)
+}
+
+// MembersLoaded returns true once all the members of the frame have been loaded with Client.LoadMembers.
+// Frames synced without lazy loading members have their full member list without loading them.
+func (frame *Frame) MembersLoaded() bool {
+	return frame.membersLoaded.Load()
+}
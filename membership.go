@@ -0,0 +1,217 @@
+package xcore
+
+// The membership states of a user in a frame.
+const (
+	MembershipJoin   = "join"
+	MembershipInvite = "invite"
+	MembershipLeave  = "leave"
+	MembershipBan    = "ban"
+	MembershipKnock  = "knock"
+)
+
+// MemberContent is the content of an m.frame.member event.
+type MemberContent struct {
+	Membership                   string `json:"membership"`
+	DisplayName                  string `json:"displayname,omitempty"`
+	AvatarURL                    string `json:"avatar_url,omitempty"`
+	Reason                       string `json:"reason,omitempty"`
+	IsDirect                     bool   `json:"is_direct,omitempty"`
+	JoinAuthorisedViaUsersServer string `json:"join_authorised_via_users_server,omitempty"`
+}
+
+// Member is a user with a membership in a frame.
+type Member struct {
+	UserID      string
+	Membership  string
+	DisplayName string
+	AvatarURL   string
+}
+
+// Members returns the users with the given membership, or all users with a membership event if membership
+// is empty, sorted by user ID.
+func (s *FrameState) Members(membership string) []Member {
+	var members []Member
+	for _, event := range s.EventsOfType("m.frame.member") {
+		member := Member{
+			UserID:     *event.StateKey,
+			Membership: s.GetMembershipState(*event.StateKey),
+		}
+		if membership != "" && member.Membership != membership {
+			continue
+		}
+		member.DisplayName, _ = event.Content["displayname"].(string)
+		member.AvatarURL, _ = event.Content["avatar_url"].(string)
+		members = append(members, member)
+	}
+	return members
+}
+
+// MemberCounts returns the number of users with each membership.
+func (s *FrameState) MemberCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, userID := range s.StateKeys("m.frame.member") {
+		counts[s.GetMembershipState(userID)]++
+	}
+	return counts
+}
+
+// Members returns the current members of the frame with the given membership. See FrameState.Members.
+func (frame *Frame) Members(membership string) []Member {
+	return frame.Snapshot().Members(membership)
+}
+
+// MemberCounts returns the number of users with each membership in the frame.
+func (frame *Frame) MemberCounts() map[string]int {
+	return frame.Snapshot().MemberCounts()
+}
+
+// MembershipChangeType is the kind of change made by an m.frame.member event.
+type MembershipChangeType int
+
+// The kinds of membership change. Changes where the sender isn't the target, such as kicks, bans and revoked
+// invites, are made by MembershipChange.Sender.
+const (
+	MembershipNoChange MembershipChangeType = iota
+	MembershipJoined
+	MembershipLeft
+	MembershipKicked
+	MembershipBanned
+	MembershipUnbanned
+	MembershipInvited
+	MembershipInviteRejected
+	MembershipInviteRevoked
+	MembershipKnocked
+	MembershipKnockRetracted
+	MembershipKnockDenied
+	MembershipDisplayNameChanged
+	MembershipAvatarChanged
+	MembershipProfileChanged // both the display name and avatar changed
+)
+
+func (t MembershipChangeType) String() string {
+	switch t {
+	case MembershipNoChange:
+		return "no change"
+	case MembershipJoined:
+		return "joined"
+	case MembershipLeft:
+		return "left"
+	case MembershipKicked:
+		return "kicked"
+	case MembershipBanned:
+		return "banned"
+	case MembershipUnbanned:
+		return "unbanned"
+	case MembershipInvited:
+		return "invited"
+	case MembershipInviteRejected:
+		return "invite rejected"
+	case MembershipInviteRevoked:
+		return "invite revoked"
+	case MembershipKnocked:
+		return "knocked"
+	case MembershipKnockRetracted:
+		return "knock retracted"
+	case MembershipKnockDenied:
+		return "knock denied"
+	case MembershipDisplayNameChanged:
+		return "display name changed"
+	case MembershipAvatarChanged:
+		return "avatar changed"
+	case MembershipProfileChanged:
+		return "profile changed"
+	}
+	return "unknown"
+}
+
+// MembershipChange describes the change made by an m.frame.member event.
+type MembershipChange struct {
+	Type            MembershipChangeType
+	UserID          string // The user whose membership changed
+	Sender          string // The user who made the change, e.g the kicker
+	Reason          string
+	PrevMembership  string // "leave" if the user had no previous membership
+	Membership      string
+	PrevDisplayName string
+	DisplayName     string
+	PrevAvatarURL   string
+	AvatarURL       string
+}
+
+// MembershipChange classifies the change made by an m.frame.member event, using its previous content. Returns
+// false if the event isn't a member event.
+func (event *Event) MembershipChange() (MembershipChange, bool) {
+	if event.Type != "m.frame.member" || event.StateKey == nil {
+		return MembershipChange{}, false
+	}
+	var content, prev MemberContent
+	if err := event.ParseContent(&content); err != nil {
+		return MembershipChange{}, false
+	}
+	if prevContent := event.PreviousContent(); prevContent != nil {
+		prevEvent := Event{Content: prevContent}
+		if err := prevEvent.ParseContent(&prev); err != nil {
+			prev = MemberContent{}
+		}
+	}
+	if prev.Membership == "" {
+		prev.Membership = MembershipLeave
+	}
+	change := MembershipChange{
+		UserID:          *event.StateKey,
+		Sender:          event.Sender,
+		Reason:          content.Reason,
+		PrevMembership:  prev.Membership,
+		Membership:      content.Membership,
+		PrevDisplayName: prev.DisplayName,
+		DisplayName:     content.DisplayName,
+		PrevAvatarURL:   prev.AvatarURL,
+		AvatarURL:       content.AvatarURL,
+	}
+	bySelf := change.Sender == change.UserID
+	switch content.Membership {
+	case MembershipJoin:
+		if prev.Membership != MembershipJoin {
+			change.Type = MembershipJoined
+		} else if prev.DisplayName != content.DisplayName && prev.AvatarURL != content.AvatarURL {
+			change.Type = MembershipProfileChanged
+		} else if prev.DisplayName != content.DisplayName {
+			change.Type = MembershipDisplayNameChanged
+		} else if prev.AvatarURL != content.AvatarURL {
+			change.Type = MembershipAvatarChanged
+		}
+	case MembershipInvite:
+		if prev.Membership != MembershipInvite {
+			change.Type = MembershipInvited
+		}
+	case MembershipBan:
+		if prev.Membership != MembershipBan {
+			change.Type = MembershipBanned
+		}
+	case MembershipKnock:
+		if prev.Membership != MembershipKnock {
+			change.Type = MembershipKnocked
+		}
+	case MembershipLeave:
+		switch prev.Membership {
+		case MembershipJoin:
+			change.Type = MembershipLeft
+			if !bySelf {
+				change.Type = MembershipKicked
+			}
+		case MembershipInvite:
+			change.Type = MembershipInviteRejected
+			if !bySelf {
+				change.Type = MembershipInviteRevoked
+			}
+		case MembershipKnock:
+			change.Type = MembershipKnockRetracted
+			if !bySelf {
+				change.Type = MembershipKnockDenied
+			}
+		case MembershipBan:
+			change.Type = MembershipUnbanned
+		}
+	}
+	return change, true
+}
@@ -0,0 +1,199 @@
+package xcore
+
+import (
+	"encoding/json"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// Mentions is the m.mentions property of an event, which lists the users the event intentionally mentions.
+// An empty Mentions means that nobody is mentioned, so receiving clients won't fall back to searching the body.
+type Mentions struct {
+	UserIDs []string `json:"user_ids,omitempty"`
+	Frame   bool     `json:"frame,omitempty"` // true if the event mentions the whole frame, i.e @frame
+}
+
+// AddUser adds the given user IDs to the mentions, skipping any which are already present.
+func (m *Mentions) AddUser(userIDs ...string) {
+	for _, userID := range userIDs {
+		if !m.HasUser(userID) {
+			m.UserIDs = append(m.UserIDs, userID)
+		}
+	}
+}
+
+// HasUser returns true if the given user ID is in the mentions.
+func (m *Mentions) HasUser(userID string) bool {
+	return containsString(m.UserIDs, userID)
+}
+
+// UserPill returns the HTML for a pill linking to the given user. If displayName is empty, the user ID is
+// used as the text of the pill.
+func UserPill(userID, displayName string) string {
+	if displayName == "" {
+		displayName = userID
+	}
+	return `<a href="` + html.EscapeString(PermalinkURL(userID)) + `">` + html.EscapeString(displayName) + `</a>`
+}
+
+// FramePill returns the HTML for a pill linking to the given frame ID or frame alias.
+func FramePill(frameIDOrAlias string) string {
+	return `<a href="` + html.EscapeString(PermalinkURL(frameIDOrAlias)) + `">` + html.EscapeString(frameIDOrAlias) + `</a>`
+}
+
+// ParsePermalink returns the user ID, frame ID or frame alias which the given permalink points to. Returns false
+// if the link isn't a permalink.
+func ParsePermalink(link string) (id string, ok bool) {
+	if !strings.HasPrefix(link, PermalinkPrefix) {
+		return "", false
+	}
+	id = strings.TrimPrefix(link, PermalinkPrefix)
+	if i := strings.IndexByte(id, '?'); i != -1 {
+		id = id[:i] // strip ?via= parameters
+	}
+	if i := strings.IndexByte(id, '/'); i != -1 {
+		id = id[:i] // strip the event ID from links to events
+	}
+	id, err := url.PathUnescape(id)
+	if err != nil || !isPillTarget(id) {
+		return "", false
+	}
+	return id, true
+}
+
+// NewMentionMessage returns an m.text message which mentions the given users. Each user is
+// prefixed to the message as a pill, e.g "Alice, Bob: text", and added to m.mentions.
+//
+// displayNames maps user IDs to the text to use for their pill, and may be nil.
+func NewMentionMessage(text string, userIDs []string, displayNames map[string]string) TextMessage {
+	mentions := Mentions{}
+	mentions.AddUser(userIDs...)
+	var plain, pills []string
+	for _, userID := range mentions.UserIDs {
+		name := displayNames[userID]
+		if name == "" {
+			name = userID
+		}
+		plain = append(plain, name)
+		pills = append(pills, UserPill(userID, name))
+	}
+	msg := TextMessage{
+		MsgType:  "m.text",
+		Body:     text,
+		Mentions: &mentions,
+	}
+	if len(pills) > 0 {
+		msg.Body = strings.Join(plain, ", ") + ": " + text
+		msg.FormattedBody = strings.Join(pills, ", ") + ": " + html.EscapeString(text)
+		msg.Format = "org.coddy.custom.html"
+	}
+	return msg
+}
+
+// NewFrameMentionMessage returns an m.text message which mentions the whole frame, i.e everyone in it. The
+// message is prefixed with "@frame: " for clients which don't support m.mentions.
+func NewFrameMentionMessage(text string) TextMessage {
+	return TextMessage{
+		MsgType:  "m.text",
+		Body:     "@frame: " + text,
+		Mentions: &Mentions{Frame: true},
+	}
+}
+
+// Mentions returns the m.mentions property of the event content. Returns false if the event has no m.mentions,
+// in which case the legacy body matching rules should be used instead.
+func (event *Event) Mentions() (*Mentions, bool) {
+	value, exists := event.Content["m.mentions"]
+	if !exists {
+		return nil, false
+	}
+	// Round-trip through JSON rather than picking apart the generic map.
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+	var mentions Mentions
+	if err = json.Unmarshal(b, &mentions); err != nil {
+		return nil, false
+	}
+	return &mentions, true
+}
+
+// PillTargets returns the user IDs, frame IDs and frame aliases which are linked to as pills in the
+// formatted_body of the event.
+func (event *Event) PillTargets() []string {
+	formattedBody, ok := event.FormattedBody()
+	if !ok {
+		return nil
+	}
+	var targets []string
+	z := nethtml.NewTokenizer(strings.NewReader(formattedBody))
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			return targets
+		}
+		if tt != nethtml.StartTagToken {
+			continue
+		}
+		token := z.Token()
+		if token.Data != "a" {
+			continue
+		}
+		for _, attr := range token.Attr {
+			if attr.Key != "href" {
+				continue
+			}
+			if id, ok := ParsePermalink(attr.Val); ok && !containsString(targets, id) {
+				targets = append(targets, id)
+			}
+		}
+	}
+}
+
+// containsWord returns true if word appears in s surrounded by word boundaries, ignoring case.
+func containsWord(s, word string) bool {
+	if word == "" {
+		return false
+	}
+	re, err := regexp.Compile(`(?i)(^|[^\pL\pN_])` + regexp.QuoteMeta(word) + `([^\pL\pN_]|$)`)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(s)
+}
+
+// IsMentioned returns true if the given event in this frame mentions the given user.
+//
+// If the event has m.mentions then only that is used: the user is mentioned if they are listed in it or the whole
+// frame is mentioned. Otherwise, the user is mentioned if there is a pill for them in the formatted_body, or the
+// body contains their display name in this frame, their localpart or "@frame".
+func (frame *Frame) IsMentioned(event *Event, userID string) bool {
+	if event.Sender == userID {
+		return false
+	}
+	if mentions, ok := event.Mentions(); ok {
+		return mentions.Frame || mentions.HasUser(userID)
+	}
+	if containsString(event.PillTargets(), userID) {
+		return true
+	}
+	body, ok := event.Body()
+	if !ok {
+		return false
+	}
+	if strings.Contains(body, "@frame") {
+		return true
+	}
+	if member := frame.GetStateEvent("m.frame.member", userID); member != nil {
+		if displayName, _ := member.Content["displayname"].(string); containsWord(body, displayName) {
+			return true
+		}
+	}
+	localpart, err := ExtractUserLocalpart(userID)
+	return err == nil && containsWord(body, localpart)
+}
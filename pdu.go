@@ -0,0 +1,358 @@
+package xcore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// EventHashes are the hashes of an event.
+type EventHashes struct {
+	SHA256 string `json:"sha256"`
+}
+
+// EventReference is a reference to another event in the prev_events or auth_events of a PDU. In frame versions 1
+// and 2 references are [event_id, hashes] pairs, in later versions they are just the event ID.
+type EventReference struct {
+	EventID string
+	Hashes  *EventHashes // Only present in frame versions 1 and 2
+}
+
+// MarshalJSON implements json.Marshaler
+func (r EventReference) MarshalJSON() ([]byte, error) {
+	if r.Hashes == nil {
+		return json.Marshal(r.EventID)
+	}
+	return json.Marshal([]interface{}{r.EventID, r.Hashes})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting both forms of reference.
+func (r *EventReference) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		r.Hashes = nil
+		return json.Unmarshal(data, &r.EventID)
+	}
+	var pair []json.RawMessage
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("event reference must be an event ID or an [event_id, hashes] pair")
+	}
+	r.Hashes = &EventHashes{}
+	if err := json.Unmarshal(pair[0], &r.EventID); err != nil {
+		return err
+	}
+	return json.Unmarshal(pair[1], r.Hashes)
+}
+
+// PDU is an event in the federation format, as sent between servers and returned by /sync when the filter has
+// an event_format of "federation".
+//
+// As with Event, unknown top-level fields are kept in Extra.
+type PDU struct {
+	EventID        string                       `json:"event_id,omitempty"` // Only present in frame versions 1 and 2
+	FrameID        string                       `json:"frame_id"`
+	Sender         string                       `json:"sender"`
+	Origin         string                       `json:"origin,omitempty"`
+	OriginServerTS int64                        `json:"origin_server_ts"`
+	Type           string                       `json:"type"`
+	StateKey       *string                      `json:"state_key,omitempty"`
+	Content        map[string]interface{}       `json:"content"`
+	PrevEvents     []EventReference             `json:"prev_events"`
+	AuthEvents     []EventReference             `json:"auth_events"`
+	Depth          int64                        `json:"depth"`
+	Redacts        string                       `json:"redacts,omitempty"`
+	Hashes         EventHashes                  `json:"hashes"`
+	Signatures     map[string]map[string]string `json:"signatures,omitempty"`
+	Unsigned       map[string]interface{}       `json:"unsigned,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"` // Top-level fields not listed above
+	Raw   json.RawMessage            `json:"-"` // The JSON the PDU was unmarshalled from. Not updated if the PDU is modified.
+}
+
+// knownPDUFields are the top-level keys handled by the fields of PDU.
+var knownPDUFields = []string{
+	"event_id", "frame_id", "sender", "origin", "origin_server_ts", "type", "state_key", "content", "prev_events",
+	"auth_events", "depth", "redacts", "hashes", "signatures", "unsigned",
+}
+
+// pduFields has the same fields as PDU but without its JSON methods.
+type pduFields PDU
+
+// UnmarshalJSON implements json.Unmarshaler, keeping unknown fields in Extra and the input in Raw.
+func (pdu *PDU) UnmarshalJSON(data []byte) error {
+	var fields pduFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	var extra map[string]json.RawMessage
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return err
+	}
+	for _, key := range knownPDUFields {
+		delete(extra, key)
+	}
+	if len(extra) == 0 {
+		extra = nil
+	}
+	*pdu = PDU(fields)
+	pdu.Extra = extra
+	pdu.Raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, including any unknown fields from Extra.
+func (pdu PDU) MarshalJSON() ([]byte, error) {
+	known, err := json.Marshal(pduFields(pdu))
+	if err != nil || len(pdu.Extra) == 0 {
+		return known, err
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(known, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range pdu.Extra {
+		if _, exists := fields[key]; !exists {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// PrevEventIDs returns the event IDs of the prev_events of the PDU.
+func (pdu *PDU) PrevEventIDs() []string {
+	return referenceIDs(pdu.PrevEvents)
+}
+
+// AuthEventIDs returns the event IDs of the auth_events of the PDU.
+func (pdu *PDU) AuthEventIDs() []string {
+	return referenceIDs(pdu.AuthEvents)
+}
+
+func referenceIDs(refs []EventReference) []string {
+	ids := make([]string, len(refs))
+	for i, ref := range refs {
+		ids[i] = ref.EventID
+	}
+	return ids
+}
+
+// genericJSON returns the PDU as a generic JSON object.
+func (pdu *PDU) genericJSON() (map[string]interface{}, error) {
+	b, err := json.Marshal(pdu)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var generic map[string]interface{}
+	err = dec.Decode(&generic)
+	return generic, err
+}
+
+// Redact returns a copy of the PDU with everything removed except the keys which are kept by the redaction
+// algorithm for the given frame version.
+func (pdu *PDU) Redact(frameVersion string) (*PDU, error) {
+	rules, err := GetFrameVersionRules(frameVersion)
+	if err != nil {
+		return nil, err
+	}
+	generic, err := pdu.genericJSON()
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(redactEventJSON(generic, rules))
+	if err != nil {
+		return nil, err
+	}
+	var redacted PDU
+	err = json.Unmarshal(b, &redacted)
+	return &redacted, err
+}
+
+// redactEventJSON applies the redaction algorithm to an event in its generic JSON form.
+func redactEventJSON(event map[string]interface{}, rules FrameVersionRules) map[string]interface{} {
+	keepKeys := []string{
+		"event_id", "type", "frame_id", "sender", "state_key", "content", "hashes", "signatures", "depth",
+		"prev_events", "auth_events", "origin_server_ts",
+	}
+	if !rules.RedactionRulesV11 {
+		keepKeys = append(keepKeys, "origin", "membership", "prev_state")
+	}
+	redacted := make(map[string]interface{})
+	for _, key := range keepKeys {
+		if value, exists := event[key]; exists {
+			redacted[key] = value
+		}
+	}
+
+	content, _ := event["content"].(map[string]interface{})
+	var keepContent []string
+	eventType, _ := event["type"].(string)
+	switch eventType {
+	case "m.frame.member":
+		keepContent = []string{"membership"}
+		if rules.RedactKeepsJoinAuthorisedVia {
+			keepContent = append(keepContent, "join_authorised_via_users_server")
+		}
+	case "m.frame.create":
+		if rules.RedactionRulesV11 {
+			redacted["content"] = content
+			return redacted
+		}
+		keepContent = []string{"creator"}
+	case "m.frame.join_rules":
+		keepContent = []string{"join_rule"}
+		if rules.RedactKeepsJoinRulesAllow {
+			keepContent = append(keepContent, "allow")
+		}
+	case "m.frame.power_levels":
+		keepContent = []string{"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"}
+		if rules.RedactionRulesV11 {
+			keepContent = append(keepContent, "invite")
+		}
+	case "m.frame.aliases":
+		if rules.RedactKeepsAliases {
+			keepContent = []string{"aliases"}
+		}
+	case "m.frame.history_visibility":
+		keepContent = []string{"history_visibility"}
+	case "m.frame.redaction":
+		if rules.RedactionRulesV11 {
+			keepContent = []string{"redacts"}
+		}
+	}
+	redactedContent := make(map[string]interface{})
+	for _, key := range keepContent {
+		if value, exists := content[key]; exists {
+			redactedContent[key] = value
+		}
+	}
+	if eventType == "m.frame.member" && rules.RedactionRulesV11 {
+		if invite, ok := content["third_party_invite"].(map[string]interface{}); ok {
+			if signed, exists := invite["signed"]; exists {
+				redactedContent["third_party_invite"] = map[string]interface{}{"signed": signed}
+			}
+		}
+	}
+	redacted["content"] = redactedContent
+	return redacted
+}
+
+// ContentHash returns the SHA-256 content hash of the PDU, which is the hash of everything except the unsigned
+// data, signatures and hashes.
+func (pdu *PDU) ContentHash() ([]byte, error) {
+	generic, err := pdu.genericJSON()
+	if err != nil {
+		return nil, err
+	}
+	delete(generic, "unsigned")
+	delete(generic, "signatures")
+	delete(generic, "hashes")
+	canonical, err := CanonicalJSON(generic)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(canonical)
+	return hash[:], nil
+}
+
+// CheckContentHash returns true if the sha256 in the hashes of the PDU matches its content hash.
+func (pdu *PDU) CheckContentHash() bool {
+	hash, err := pdu.ContentHash()
+	if err != nil {
+		return false
+	}
+	return base64.RawStdEncoding.EncodeToString(hash) == pdu.Hashes.SHA256
+}
+
+// ReferenceHash returns the SHA-256 reference hash of the PDU, which is the hash of the redacted PDU without
+// its unsigned data or signatures.
+func (pdu *PDU) ReferenceHash(frameVersion string) ([]byte, error) {
+	rules, err := GetFrameVersionRules(frameVersion)
+	if err != nil {
+		return nil, err
+	}
+	generic, err := pdu.genericJSON()
+	if err != nil {
+		return nil, err
+	}
+	redacted := redactEventJSON(generic, rules)
+	delete(redacted, "signatures")
+	delete(redacted, "unsigned")
+	canonical, err := CanonicalJSON(redacted)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(canonical)
+	return hash[:], nil
+}
+
+// EventIDForVersion returns the event ID of the PDU in the given frame version. In versions 1 and 2 this is the
+// event_id of the PDU, in later versions it is derived from the reference hash.
+func (pdu *PDU) EventIDForVersion(frameVersion string) (string, error) {
+	rules, err := GetFrameVersionRules(frameVersion)
+	if err != nil {
+		return "", err
+	}
+	if rules.EventIDFormat == EventIDFormatV1 {
+		if pdu.EventID == "" {
+			return "", fmt.Errorf("PDU in frame version %s has no event_id", frameVersion)
+		}
+		return pdu.EventID, nil
+	}
+	hash, err := pdu.ReferenceHash(frameVersion)
+	if err != nil {
+		return "", err
+	}
+	if rules.EventIDFormat == EventIDFormatV3 {
+		return "$" + base64.RawStdEncoding.EncodeToString(hash), nil
+	}
+	return "$" + base64.RawURLEncoding.EncodeToString(hash), nil
+}
+
+// ToClientEvent converts the PDU into the client event format, calculating the event ID for the given frame
+// version if needed. Federation-only fields such as auth_events and signatures are not included.
+func (pdu *PDU) ToClientEvent(frameVersion string) (*Event, error) {
+	eventID, err := pdu.EventIDForVersion(frameVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &Event{
+		StateKey:  pdu.StateKey,
+		Sender:    pdu.Sender,
+		Type:      pdu.Type,
+		Timestamp: pdu.OriginServerTS,
+		ID:        eventID,
+		FrameID:   pdu.FrameID,
+		Redacts:   pdu.Redacts,
+		Unsigned:  pdu.Unsigned,
+		Content:   pdu.Content,
+	}, nil
+}
+
+// PDUFromEvent converts an event which was received in the federation format, e.g from /sync with a filter with
+// an event_format of "federation", into a PDU. The federation fields are read from the Extra fields of the event.
+// The event_id is only kept for frame versions where it is part of the PDU.
+func PDUFromEvent(event *Event, frameVersion string) (*PDU, error) {
+	rules, err := GetFrameVersionRules(frameVersion)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var pdu PDU
+	if err = json.Unmarshal(b, &pdu); err != nil {
+		return nil, err
+	}
+	if rules.EventIDFormat != EventIDFormatV1 {
+		pdu.EventID = ""
+	}
+	return &pdu, nil
+}
@@ -0,0 +1,234 @@
+package xcore
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// PendingEventStatus is the status of a message event sent by this client.
+type PendingEventStatus int
+
+// The statuses of a pending event. An event starts as PendingEventSending and moves to PendingEventSent once the
+// homeserver accepts it, then to PendingEventEchoed once it comes down /sync. The echo can arrive before the
+// send request completes, in which case the event goes straight from PendingEventSending to PendingEventEchoed.
+const (
+	PendingEventSending PendingEventStatus = iota
+	PendingEventSent
+	PendingEventEchoed
+	PendingEventFailed
+	PendingEventCancelled
+)
+
+func (s PendingEventStatus) String() string {
+	switch s {
+	case PendingEventSending:
+		return "sending"
+	case PendingEventSent:
+		return "sent"
+	case PendingEventEchoed:
+		return "echoed"
+	case PendingEventFailed:
+		return "failed"
+	case PendingEventCancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// PendingEvent is a message event sent by this client which hasn't yet come back down /sync.
+type PendingEvent struct {
+	TxnID   string
+	FrameID string
+	Type    string
+	Content interface{}
+	Status  PendingEventStatus
+	EventID string // The event ID, once the homeserver has accepted the event
+	Err     error  // The error from the last attempt to send the event, if it failed
+	Echo    *Event // The event as it came down /sync, once echoed
+
+	sentAt time.Time // when the homeserver accepted the event
+}
+
+// PendingEventListener can be used with PendingEvents.OnStatusChange to be informed when a pending event
+// changes status.
+type PendingEventListener func(PendingEvent)
+
+// ErrUnknownPendingEvent is returned when retrying or cancelling an event which isn't pending.
+var ErrUnknownPendingEvent = errors.New("no pending event with that transaction ID")
+
+// DefaultPendingEventTTL is how long PendingEvents keeps sent events which haven't been echoed, unless
+// PendingEvents.SentTTL is changed.
+const DefaultPendingEventTTL = 10 * time.Minute
+
+// PendingEvents tracks the message events sent by a Client until they come back down /sync as local echoes,
+// which are matched up using the transaction ID in their unsigned data. Tracking is opt-in: see
+// Client.TrackPendingEvents.
+//
+// Events are forgotten once they are echoed or cancelled. Sent events which are never echoed, e.g because the
+// client isn't syncing or the echo was in a skipped sync response, are forgotten SentTTL after they were sent,
+// without notifying listeners. Failed events are kept until they are retried or cancelled.
+type PendingEvents struct {
+	// How long sent events are kept waiting for their echo. Must be set before any events are sent.
+	SentTTL time.Duration
+
+	mu        sync.Mutex
+	events    map[string]*PendingEvent // txn ID to event
+	listeners []PendingEventListener
+}
+
+// NewPendingEvents returns an empty PendingEvents.
+func NewPendingEvents() *PendingEvents {
+	return &PendingEvents{
+		SentTTL: DefaultPendingEventTTL,
+		events:  make(map[string]*PendingEvent),
+	}
+}
+
+// evictExpired forgets sent events which have been waiting longer than SentTTL for their echo. The lock must be
+// held.
+func (p *PendingEvents) evictExpired(now time.Time) {
+	for txnID, pending := range p.events {
+		if pending.Status == PendingEventSent && now.Sub(pending.sentAt) > p.SentTTL {
+			delete(p.events, txnID)
+		}
+	}
+}
+
+// OnStatusChange allows callers to be notified whenever a pending event changes status. Listeners are called
+// on the goroutine which caused the change: either the one sending the event or the one syncing.
+func (p *PendingEvents) OnStatusChange(callback PendingEventListener) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listeners = append(p.listeners, callback)
+}
+
+// Get returns the pending event with the given transaction ID.
+func (p *PendingEvents) Get(txnID string) (PendingEvent, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, exists := p.events[txnID]
+	if !exists {
+		return PendingEvent{}, false
+	}
+	return *pending, true
+}
+
+// List returns the pending events in the given frame, or in all frames if frameID is empty.
+func (p *PendingEvents) List(frameID string) []PendingEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var list []PendingEvent
+	for _, pending := range p.events {
+		if frameID == "" || pending.FrameID == frameID {
+			list = append(list, *pending)
+		}
+	}
+	return list
+}
+
+// update applies fn to the pending event with the given transaction ID under the lock, then notifies
+// listeners if the status changed. Returns false if there is no such event.
+func (p *PendingEvents) update(txnID string, fn func(pending *PendingEvent)) bool {
+	p.mu.Lock()
+	pending, exists := p.events[txnID]
+	if !exists {
+		p.mu.Unlock()
+		return false
+	}
+	before := pending.Status
+	fn(pending)
+	changed := *pending
+	if pending.Status == PendingEventEchoed || pending.Status == PendingEventCancelled {
+		delete(p.events, txnID)
+	}
+	p.mu.Unlock()
+
+	if changed.Status != before {
+		p.notify(changed)
+	}
+	return true
+}
+
+func (p *PendingEvents) notify(pending PendingEvent) {
+	p.mu.Lock()
+	listeners := p.listeners
+	p.mu.Unlock()
+	for _, fn := range listeners {
+		fn(pending)
+	}
+}
+
+// sending records that an event is about to be sent. Retries of failed events reuse their existing entry.
+func (p *PendingEvents) sending(txnID, frameID, eventType string, content interface{}) {
+	p.mu.Lock()
+	p.evictExpired(time.Now())
+	if _, exists := p.events[txnID]; exists {
+		p.mu.Unlock()
+		p.update(txnID, func(pending *PendingEvent) {
+			pending.Status = PendingEventSending
+			pending.Err = nil
+		})
+		return
+	}
+	pending := &PendingEvent{
+		TxnID:   txnID,
+		FrameID: frameID,
+		Type:    eventType,
+		Content: content,
+		Status:  PendingEventSending,
+	}
+	p.events[txnID] = pending
+	created := *pending
+	p.mu.Unlock()
+	p.notify(created)
+}
+
+// sent records the result of sending an event.
+func (p *PendingEvents) sent(txnID string, resp *RespSendEvent, err error) {
+	p.update(txnID, func(pending *PendingEvent) {
+		if pending.Status != PendingEventSending {
+			return // cancelled or echoed in the meantime
+		}
+		if err != nil {
+			pending.Status = PendingEventFailed
+			pending.Err = err
+			return
+		}
+		pending.Status = PendingEventSent
+		pending.sentAt = time.Now()
+		if resp != nil {
+			pending.EventID = resp.EventID
+		}
+	})
+}
+
+// Match checks whether the given event from /sync is the local echo of a pending event, marking the pending
+// event as echoed if so. Returns the pending event and true if it matched.
+func (p *PendingEvents) Match(event *Event) (PendingEvent, bool) {
+	txnID := event.TransactionID()
+	if txnID == "" {
+		return PendingEvent{}, false
+	}
+	echo := *event
+	var matched PendingEvent
+	found := p.update(txnID, func(pending *PendingEvent) {
+		pending.Status = PendingEventEchoed
+		pending.EventID = event.ID
+		pending.Echo = &echo
+		pending.Err = nil
+		matched = *pending
+	})
+	return matched, found
+}
+
+// Cancel stops tracking the pending event with the given transaction ID. If the event is still being sent it
+// may still arrive in the frame, but it will no longer be tracked.
+func (p *PendingEvents) Cancel(txnID string) error {
+	if !p.update(txnID, func(pending *PendingEvent) {
+		pending.Status = PendingEventCancelled
+	}) {
+		return ErrUnknownPendingEvent
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package xcore
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Poll kinds. The results of disclosed polls are visible while the poll is running, whereas undisclosed polls
+// only show results once the poll has ended.
+const (
+	PollKindDisclosed   = "m.poll.disclosed"
+	PollKindUndisclosed = "m.poll.undisclosed"
+)
+
+// RelatesTo is the m.relates_to property of an event, which relates it to another event.
+type RelatesTo struct {
+	RelType string `json:"rel_type"`
+	EventID string `json:"event_id"`
+}
+
+// TextRepresentation is one representation of some text in an m.text block. The mimetype defaults to text/plain.
+type TextRepresentation struct {
+	Body     string `json:"body"`
+	MimeType string `json:"mimetype,omitempty"`
+}
+
+// PollAnswer is a possible answer to a poll.
+type PollAnswer struct {
+	ID   string               `json:"m.id"`
+	Text []TextRepresentation `json:"m.text"`
+}
+
+// PollQuestion is the question being asked by a poll.
+type PollQuestion struct {
+	Text []TextRepresentation `json:"m.text"`
+}
+
+// PollStart is the m.poll block of an m.poll.start event.
+type PollStart struct {
+	Kind          string       `json:"kind"`
+	MaxSelections int          `json:"max_selections"`
+	Question      PollQuestion `json:"question"`
+	Answers       []PollAnswer `json:"answers"`
+}
+
+// PollStartContent is the content of an m.poll.start event.
+type PollStartContent struct {
+	Poll PollStart            `json:"m.poll"`
+	Text []TextRepresentation `json:"m.text"` // fallback for clients which don't support polls
+}
+
+// PollResponseContent is the content of an m.poll.response event.
+type PollResponseContent struct {
+	RelatesTo  RelatesTo `json:"m.relates_to"`
+	Selections []string  `json:"m.selections"`
+}
+
+// PollEndContent is the content of an m.poll.end event.
+type PollEndContent struct {
+	RelatesTo RelatesTo            `json:"m.relates_to"`
+	Text      []TextRepresentation `json:"m.text"`
+	Results   map[string]int       `json:"m.poll.results,omitempty"`
+}
+
+// NewPollStart returns the content of an m.poll.start event asking the given question. Answers are given the IDs
+// "1", "2", etc in order. maxSelections is clamped to between 1 and the number of answers.
+func NewPollStart(question string, answers []string, kind string, maxSelections int) PollStartContent {
+	if maxSelections < 1 {
+		maxSelections = 1
+	}
+	if maxSelections > len(answers) && len(answers) > 0 {
+		maxSelections = len(answers)
+	}
+	fallback := question
+	content := PollStartContent{
+		Poll: PollStart{
+			Kind:          kind,
+			MaxSelections: maxSelections,
+			Question:      PollQuestion{Text: []TextRepresentation{{Body: question}}},
+		},
+	}
+	for i, answer := range answers {
+		id := strconv.Itoa(i + 1)
+		content.Poll.Answers = append(content.Poll.Answers, PollAnswer{
+			ID:   id,
+			Text: []TextRepresentation{{Body: answer}},
+		})
+		fallback += "\n" + id + ". " + answer
+	}
+	content.Text = []TextRepresentation{{Body: fallback}}
+	return content
+}
+
+// Poll aggregates the responses to a poll in order to tally the votes. Events can be added in any order,
+// e.g. as they arrive from /sync or from paginating with Client.Messages.
+type Poll struct {
+	Start   *Event
+	Content PollStartContent
+
+	votes map[string][]pollVote // user ID to all of their votes
+	end   *Event                // the earliest valid m.poll.end
+}
+
+type pollVote struct {
+	timestamp  int64
+	selections []string
+}
+
+// PollResults are the results of a poll.
+type PollResults struct {
+	// The number of votes for each answer ID. Every answer is present, even if it received no votes.
+	Votes map[string]int
+	// The valid answers selected by each user. Users whose vote was spoiled have no selections.
+	Voters map[string][]string
+	// The answer IDs with the most votes, in the order they appear in the poll. Empty if there are no votes.
+	Winners []string
+	// True if the poll has been closed by an m.poll.end event.
+	Ended bool
+}
+
+// NewPoll returns a Poll for the given m.poll.start event, or an error if the event isn't a valid poll.
+func NewPoll(start *Event) (*Poll, error) {
+	if start.Type != "m.poll.start" {
+		return nil, fmt.Errorf("event %s is not a poll start event", start.ID)
+	}
+	var content PollStartContent
+	if err := start.ParseContent(&content); err != nil {
+		return nil, err
+	}
+	if len(content.Poll.Answers) == 0 {
+		return nil, fmt.Errorf("poll %s has no answers", start.ID)
+	}
+	if content.Poll.MaxSelections < 1 {
+		content.Poll.MaxSelections = 1
+	}
+	return &Poll{
+		Start:   start,
+		Content: content,
+		votes:   make(map[string][]pollVote),
+	}, nil
+}
+
+// relatesToPoll returns true if the event is a reference to this poll.
+func (p *Poll) relatesToPoll(relatesTo RelatesTo) bool {
+	return relatesTo.RelType == "m.reference" && relatesTo.EventID == p.Start.ID
+}
+
+// Add adds m.poll.response and m.poll.end events to the poll. Events which aren't for this poll are ignored.
+//
+// Only the latest response from each user counts. The poll can only be ended by the user who started it, and
+// responses sent before the poll started or after it ended are ignored.
+func (p *Poll) Add(events ...*Event) {
+	for _, event := range events {
+		if event.Timestamp < p.Start.Timestamp {
+			continue
+		}
+		switch event.Type {
+		case "m.poll.response":
+			var content PollResponseContent
+			if err := event.ParseContent(&content); err != nil || !p.relatesToPoll(content.RelatesTo) {
+				continue
+			}
+			// Keep every vote as the poll may be ended by an event we haven't seen yet.
+			p.votes[event.Sender] = append(p.votes[event.Sender], pollVote{
+				timestamp:  event.Timestamp,
+				selections: p.validSelections(content.Selections),
+			})
+		case "m.poll.end":
+			var content PollEndContent
+			if err := event.ParseContent(&content); err != nil || !p.relatesToPoll(content.RelatesTo) {
+				continue
+			}
+			if event.Sender != p.Start.Sender {
+				continue
+			}
+			if p.end == nil || event.Timestamp < p.end.Timestamp {
+				p.end = event
+			}
+		}
+	}
+}
+
+// validSelections removes unknown and duplicate answer IDs from the selections, and truncates them to the
+// maximum number of selections. An empty result means the vote is spoiled.
+func (p *Poll) validSelections(selections []string) []string {
+	var valid []string
+	for _, id := range selections {
+		if len(valid) == p.Content.Poll.MaxSelections {
+			break
+		}
+		if p.answer(id) != nil && !containsString(valid, id) {
+			valid = append(valid, id)
+		}
+	}
+	return valid
+}
+
+func (p *Poll) answer(id string) *PollAnswer {
+	for i := range p.Content.Poll.Answers {
+		if p.Content.Poll.Answers[i].ID == id {
+			return &p.Content.Poll.Answers[i]
+		}
+	}
+	return nil
+}
+
+// Ended returns true if the poll has been closed.
+func (p *Poll) Ended() bool {
+	return p.end != nil
+}
+
+// Results tallies the votes in the poll. Votes sent after the poll ended are not counted.
+//
+// Results are returned for undisclosed polls which are still running: it's up to the caller not to show them.
+func (p *Poll) Results() PollResults {
+	results := PollResults{
+		Votes:  make(map[string]int),
+		Voters: make(map[string][]string),
+		Ended:  p.end != nil,
+	}
+	for _, answer := range p.Content.Poll.Answers {
+		results.Votes[answer.ID] = 0
+	}
+	for userID, votes := range p.votes {
+		// Use the latest vote before the poll ended. Ties go to the vote which was added last.
+		var vote *pollVote
+		for i := range votes {
+			if p.end != nil && votes[i].timestamp > p.end.Timestamp {
+				continue
+			}
+			if vote == nil || votes[i].timestamp >= vote.timestamp {
+				vote = &votes[i]
+			}
+		}
+		if vote == nil {
+			continue
+		}
+		results.Voters[userID] = vote.selections
+		for _, id := range vote.selections {
+			results.Votes[id]++
+		}
+	}
+	best := 0
+	for _, answer := range p.Content.Poll.Answers {
+		switch count := results.Votes[answer.ID]; {
+		case count == 0 || count < best:
+		case count > best:
+			best = count
+			results.Winners = []string{answer.ID}
+		default:
+			results.Winners = append(results.Winners, answer.ID)
+		}
+	}
+	return results
+}
+
+// TallyPoll returns the results of the poll started by the given m.poll.start event, counting the votes
+// in the given events. See Poll.Add for the rules applied.
+func TallyPoll(start *Event, events []Event) (PollResults, error) {
+	poll, err := NewPoll(start)
+	if err != nil {
+		return PollResults{}, err
+	}
+	// Add the events in timestamp order so that ties are broken by the order they were given in.
+	sorted := make([]*Event, len(events))
+	for i := range events {
+		sorted[i] = &events[i]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+	poll.Add(sorted...)
+	return poll.Results(), nil
+}
@@ -0,0 +1,381 @@
+package xcore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// The default power levels used when a field is missing from the m.frame.power_levels event.
+const (
+	DefaultBanLevel          = 50
+	DefaultKickLevel         = 50
+	DefaultRedactLevel       = 50
+	DefaultInviteLevel       = 0
+	DefaultEventsLevel       = 0
+	DefaultStateLevel        = 50
+	DefaultUsersLevel        = 0
+	DefaultFrameNotifyLevel  = 50
+	DefaultCreatorPowerLevel = 100 // the level of the frame creator when there is no m.frame.power_levels event
+)
+
+// PowerLevel is a power level. Older frame versions allow power levels to be sent as strings containing an
+// integer, so these are accepted when unmarshalling.
+type PowerLevel int64
+
+// UnmarshalJSON accepts an integer, or a string containing an integer.
+func (level *PowerLevel) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		data = []byte(str)
+	}
+	parsed, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid power level %s", data)
+	}
+	*level = PowerLevel(parsed)
+	return nil
+}
+
+// powerLevel returns a pointer to the given level, for setting the optional fields of PowerLevelsContent.
+func powerLevel(level int64) *PowerLevel {
+	pl := PowerLevel(level)
+	return &pl
+}
+
+// PowerLevelsContent is the content of an m.frame.power_levels event. Fields which are nil are missing from the
+// event and take their default value, which is what the accessor methods return.
+type PowerLevelsContent struct {
+	Ban           *PowerLevel           `json:"ban,omitempty"`
+	Kick          *PowerLevel           `json:"kick,omitempty"`
+	Redact        *PowerLevel           `json:"redact,omitempty"`
+	Invite        *PowerLevel           `json:"invite,omitempty"`
+	EventsDefault *PowerLevel           `json:"events_default,omitempty"`
+	StateDefault  *PowerLevel           `json:"state_default,omitempty"`
+	UsersDefault  *PowerLevel           `json:"users_default,omitempty"`
+	Events        map[string]PowerLevel `json:"events,omitempty"`
+	Users         map[string]PowerLevel `json:"users,omitempty"`
+	Notifications map[string]PowerLevel `json:"notifications,omitempty"`
+}
+
+func levelOrDefault(level *PowerLevel, def int64) int64 {
+	if level == nil {
+		return def
+	}
+	return int64(*level)
+}
+
+// BanLevel returns the level required to ban a user.
+func (c *PowerLevelsContent) BanLevel() int64 { return levelOrDefault(c.Ban, DefaultBanLevel) }
+
+// KickLevel returns the level required to kick a user.
+func (c *PowerLevelsContent) KickLevel() int64 { return levelOrDefault(c.Kick, DefaultKickLevel) }
+
+// RedactLevel returns the level required to redact an event sent by another user.
+func (c *PowerLevelsContent) RedactLevel() int64 { return levelOrDefault(c.Redact, DefaultRedactLevel) }
+
+// InviteLevel returns the level required to invite a user.
+func (c *PowerLevelsContent) InviteLevel() int64 { return levelOrDefault(c.Invite, DefaultInviteLevel) }
+
+// EventsDefaultLevel returns the level required to send message events not listed in Events.
+func (c *PowerLevelsContent) EventsDefaultLevel() int64 {
+	return levelOrDefault(c.EventsDefault, DefaultEventsLevel)
+}
+
+// StateDefaultLevel returns the level required to send state events not listed in Events.
+func (c *PowerLevelsContent) StateDefaultLevel() int64 {
+	return levelOrDefault(c.StateDefault, DefaultStateLevel)
+}
+
+// UsersDefaultLevel returns the level of users not listed in Users.
+func (c *PowerLevelsContent) UsersDefaultLevel() int64 {
+	return levelOrDefault(c.UsersDefault, DefaultUsersLevel)
+}
+
+// UserLevel returns the level of the given user.
+func (c *PowerLevelsContent) UserLevel(userID string) int64 {
+	if level, ok := c.Users[userID]; ok {
+		return int64(level)
+	}
+	return c.UsersDefaultLevel()
+}
+
+// EventLevel returns the level required to send an event of the given type.
+func (c *PowerLevelsContent) EventLevel(eventType string, isState bool) int64 {
+	if level, ok := c.Events[eventType]; ok {
+		return int64(level)
+	}
+	if isState {
+		return c.StateDefaultLevel()
+	}
+	return c.EventsDefaultLevel()
+}
+
+// NotificationLevel returns the level required to trigger the given notification, e.g "frame" for @frame
+// notifications.
+func (c *PowerLevelsContent) NotificationLevel(key string) int64 {
+	if level, ok := c.Notifications[key]; ok {
+		return int64(level)
+	}
+	if key == "frame" {
+		return DefaultFrameNotifyLevel
+	}
+	return DefaultUsersLevel
+}
+
+// Copy returns a deep copy of the content, which can be modified without affecting the original.
+func (c *PowerLevelsContent) Copy() *PowerLevelsContent {
+	copied := *c
+	copyLevel := func(level *PowerLevel) *PowerLevel {
+		if level == nil {
+			return nil
+		}
+		return powerLevel(int64(*level))
+	}
+	copyLevels := func(levels map[string]PowerLevel) map[string]PowerLevel {
+		if levels == nil {
+			return nil
+		}
+		out := make(map[string]PowerLevel, len(levels))
+		for key, level := range levels {
+			out[key] = level
+		}
+		return out
+	}
+	copied.Ban = copyLevel(c.Ban)
+	copied.Kick = copyLevel(c.Kick)
+	copied.Redact = copyLevel(c.Redact)
+	copied.Invite = copyLevel(c.Invite)
+	copied.EventsDefault = copyLevel(c.EventsDefault)
+	copied.StateDefault = copyLevel(c.StateDefault)
+	copied.UsersDefault = copyLevel(c.UsersDefault)
+	copied.Events = copyLevels(c.Events)
+	copied.Users = copyLevels(c.Users)
+	copied.Notifications = copyLevels(c.Notifications)
+	return &copied
+}
+
+// SetUserLevel sets the level of the given user. Users set to the default level are removed from Users.
+func (c *PowerLevelsContent) SetUserLevel(userID string, level int64) {
+	if level == c.UsersDefaultLevel() {
+		delete(c.Users, userID)
+		return
+	}
+	if c.Users == nil {
+		c.Users = make(map[string]PowerLevel)
+	}
+	c.Users[userID] = PowerLevel(level)
+}
+
+// SetEventLevel sets the level required to send events of the given type.
+func (c *PowerLevelsContent) SetEventLevel(eventType string, level int64) {
+	if c.Events == nil {
+		c.Events = make(map[string]PowerLevel)
+	}
+	c.Events[eventType] = PowerLevel(level)
+}
+
+// PowerLevels evaluates what users are allowed to do in a frame, based on its m.frame.power_levels and
+// m.frame.create events.
+type PowerLevels struct {
+	PowerLevelsContent
+
+	// Exists is false if the frame has no m.frame.power_levels event, in which case the frame creator has
+	// DefaultCreatorPowerLevel and everyone else can send any event.
+	Exists  bool
+	Creator string
+}
+
+// NewPowerLevels returns the power levels given by the m.frame.power_levels and m.frame.create events,
+// either of which may be nil.
+func NewPowerLevels(powerLevelsEvent, createEvent *Event) (*PowerLevels, error) {
+	pl := &PowerLevels{}
+	if createEvent != nil {
+		pl.Creator = frameCreator(createEvent)
+	}
+	if powerLevelsEvent != nil {
+		if err := powerLevelsEvent.ParseContent(&pl.PowerLevelsContent); err != nil {
+			return nil, err
+		}
+		pl.Exists = true
+	}
+	return pl, nil
+}
+
+// frameCreator returns the creator of the frame given its m.frame.create event. Frame versions before 11 have a
+// "creator" field in the content, later versions use the sender.
+func frameCreator(createEvent *Event) string {
+	if creator, ok := createEvent.Content["creator"].(string); ok && creator != "" {
+		return creator
+	}
+	return createEvent.Sender
+}
+
+// PowerLevels returns the power levels of the frame in this state.
+func (s *FrameState) PowerLevels() (*PowerLevels, error) {
+	return NewPowerLevels(s.GetStateEvent("m.frame.power_levels", ""), s.GetStateEvent("m.frame.create", ""))
+}
+
+// PowerLevels returns the current power levels of the frame.
+func (frame *Frame) PowerLevels() (*PowerLevels, error) {
+	return frame.Snapshot().PowerLevels()
+}
+
+// UserLevel returns the level of the given user.
+func (pl *PowerLevels) UserLevel(userID string) int64 {
+	if !pl.Exists {
+		if userID == pl.Creator {
+			return DefaultCreatorPowerLevel
+		}
+		return DefaultUsersLevel
+	}
+	return pl.PowerLevelsContent.UserLevel(userID)
+}
+
+// EventLevel returns the level required to send an event of the given type.
+func (pl *PowerLevels) EventLevel(eventType string, isState bool) int64 {
+	if !pl.Exists {
+		return DefaultEventsLevel
+	}
+	return pl.PowerLevelsContent.EventLevel(eventType, isState)
+}
+
+// CanSend returns true if the user can send an event of the given type.
+func (pl *PowerLevels) CanSend(userID, eventType string, isState bool) bool {
+	return pl.UserLevel(userID) >= pl.EventLevel(eventType, isState)
+}
+
+// CanInvite returns true if the user can invite other users.
+func (pl *PowerLevels) CanInvite(userID string) bool {
+	return pl.UserLevel(userID) >= pl.InviteLevel()
+}
+
+// CanKick returns true if the user can kick the target, which requires the kick level and a higher level
+// than the target.
+func (pl *PowerLevels) CanKick(userID, targetUserID string) bool {
+	level := pl.UserLevel(userID)
+	return level >= pl.KickLevel() && level > pl.UserLevel(targetUserID)
+}
+
+// CanBan returns true if the user can ban or unban the target, which requires the ban level and a higher
+// level than the target.
+func (pl *PowerLevels) CanBan(userID, targetUserID string) bool {
+	level := pl.UserLevel(userID)
+	return level >= pl.BanLevel() && level > pl.UserLevel(targetUserID)
+}
+
+// CanRedact returns true if the user can redact an event sent by the given sender. Users can always redact
+// their own events if they can send redactions, but need the redact level to redact events of other users.
+func (pl *PowerLevels) CanRedact(userID, eventSender string) bool {
+	if !pl.CanSend(userID, "m.frame.redaction", false) {
+		return false
+	}
+	return userID == eventSender || pl.UserLevel(userID) >= pl.RedactLevel()
+}
+
+// CanNotify returns true if the user can trigger the given notification, e.g "frame" for @frame notifications.
+func (pl *PowerLevels) CanNotify(userID, key string) bool {
+	return pl.UserLevel(userID) >= pl.NotificationLevel(key)
+}
+
+// CanSetUserLevel returns true if the user can change the level of the target to the given level. Users can
+// lower their own level, but can't raise anyone above their own level or change the level of other users
+// whose level is not lower than their own.
+func (pl *PowerLevels) CanSetUserLevel(userID, targetUserID string, level int64) bool {
+	if !pl.CanSend(userID, "m.frame.power_levels", true) {
+		return false
+	}
+	own := pl.UserLevel(userID)
+	if level > own {
+		return false
+	}
+	return userID == targetUserID || pl.UserLevel(targetUserID) < own
+}
+
+// Content returns a copy of the power levels content which can be modified and sent as a new
+// m.frame.power_levels event. If the frame has no power levels event, the creator is given
+// DefaultCreatorPowerLevel so that they don't lose their power when the event is sent.
+func (pl *PowerLevels) Content() *PowerLevelsContent {
+	content := pl.PowerLevelsContent.Copy()
+	if !pl.Exists && pl.Creator != "" {
+		content.SetUserLevel(pl.Creator, DefaultCreatorPowerLevel)
+	}
+	return content
+}
+
+// WithUserLevel returns a copy of the power levels content with the given user's level changed.
+func (pl *PowerLevels) WithUserLevel(userID string, level int64) *PowerLevelsContent {
+	content := pl.Content()
+	content.SetUserLevel(userID, level)
+	return content
+}
+
+// SendPowerLevels sends a new m.frame.power_levels event to the given frame.
+func (cli *Client) SendPowerLevels(frameID string, content *PowerLevelsContent) (*RespSendEvent, error) {
+	return cli.SendStateEvent(frameID, "m.frame.power_levels", "", content)
+}
+
+// SetUserPowerLevel fetches the current power levels of the given frame and sends a new m.frame.power_levels
+// event with the given user's level changed, e.g to promote them to moderator. The rest of the content is sent
+// back unchanged, including any keys this package doesn't know about. If the frame has no power levels event,
+// the spec defaults are used, where the frame creator has level 100.
+func (cli *Client) SetUserPowerLevel(frameID, userID string, level int64) (*RespSendEvent, error) {
+	var content map[string]interface{}
+	err := cli.StateEvent(frameID, "m.frame.power_levels", "", &content)
+	if httpErr, ok := err.(HTTPError); ok && httpErr.Code == http.StatusNotFound {
+		creator, err := cli.frameCreatorID(frameID)
+		if err != nil {
+			return nil, err
+		}
+		// Without a power levels event state_default is 0 rather than 50, so keep it that way.
+		content = map[string]interface{}{
+			"users":         map[string]interface{}{creator: DefaultCreatorPowerLevel},
+			"state_default": 0,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		content = make(map[string]interface{})
+	}
+
+	// Decode the typed content only to find users_default, which may be a string in older frame versions.
+	var typed PowerLevelsContent
+	if b, err := json.Marshal(content); err == nil {
+		_ = json.Unmarshal(b, &typed)
+	}
+	users, _ := content["users"].(map[string]interface{})
+	if users == nil {
+		users = make(map[string]interface{})
+	}
+	if level == typed.UsersDefaultLevel() {
+		delete(users, userID)
+	} else {
+		users[userID] = level
+	}
+	content["users"] = users
+	return cli.SendStateEvent(frameID, "m.frame.power_levels", "", content)
+}
+
+// frameCreatorID returns the creator of the frame: the creator in the content of its m.frame.create event, or
+// the sender of the event in frame versions which removed that field.
+func (cli *Client) frameCreatorID(frameID string) (string, error) {
+	var createContent CreateContent
+	if err := cli.StateEvent(frameID, "m.frame.create", "", &createContent); err != nil {
+		return "", err
+	}
+	if createContent.Creator != "" {
+		return createContent.Creator, nil
+	}
+	events, err := cli.GetFrameState(frameID)
+	if err != nil {
+		return "", err
+	}
+	for i := range events {
+		if events[i].Type == "m.frame.create" && events[i].StateKey != nil && *events[i].StateKey == "" {
+			return frameCreator(&events[i]), nil
+		}
+	}
+	return "", fmt.Errorf("frame %s has no m.frame.create event", frameID)
+}
@@ -35,6 +35,22 @@ type ReqCreateFrame struct {
 	InitialState    []Event                `json:"initial_state,omitempty"`
 	Preset          string                 `json:"preset,omitempty"`
 	IsDirect        bool                   `json:"is_direct,omitempty"`
+	FrameVersion    string                 `json:"frame_version,omitempty"` // The server's default version is used if empty
+}
+
+// ReqUpgradeFrame is the JSON request
+type ReqUpgradeFrame struct {
+	NewVersion string `json:"new_version"`
+}
+
+// ReqAliasCreate is the JSON request
+type ReqAliasCreate struct {
+	FrameID string `json:"frame_id"`
+}
+
+// ReqFrameDirectoryVisibility is the JSON request
+type ReqFrameDirectoryVisibility struct {
+	Visibility string `json:"visibility"`
 }
 
 // ReqRedact is the JSON request
@@ -42,6 +58,11 @@ type ReqRedact struct {
 	Reason string `json:"reason,omitempty"`
 }
 
+// ReqKnockFrame is the JSON request
+type ReqKnockFrame struct {
+	Reason string `json:"reason,omitempty"`
+}
+
 // ReqInvite3PID is the JSON request
 // It is also a JSON object
 type ReqInvite3PID struct {
@@ -30,11 +30,61 @@ type RespPublicFrames struct {
 	Chunk                  []PublicFrame `json:"chunk"`
 }
 
+// RespHierarchy is the JSON response for Client.Hierarchy
+type RespHierarchy struct {
+	Frames    []HierarchyFrame `json:"frames"`
+	NextBatch string           `json:"next_batch,omitempty"`
+}
+
+// HierarchyFrame is a frame in a space tree, as returned by the /hierarchy API
+type HierarchyFrame struct {
+	PublicFrame
+	FrameType     string  `json:"frame_type,omitempty"`
+	JoinRule      string  `json:"join_rule,omitempty"`
+	ChildrenState []Event `json:"children_state"`
+}
+
+// RespAliasResolve is the JSON response
+type RespAliasResolve struct {
+	FrameID string   `json:"frame_id"`
+	Servers []string `json:"servers"`
+}
+
+// RespAliasList is the JSON response
+type RespAliasList struct {
+	Aliases []string `json:"aliases"`
+}
+
+// RespFrameDirectoryVisibility is the JSON response
+type RespFrameDirectoryVisibility struct {
+	Visibility string `json:"visibility"`
+}
+
+// RespCapabilities is the JSON response
+type RespCapabilities struct {
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+// RespMembers is the JSON response
+type RespMembers struct {
+	Chunk []Event `json:"chunk"`
+}
+
 // RespJoinFrame is the JSON response
 type RespJoinFrame struct {
 	FrameID string `json:"frame_id"`
 }
 
+// RespKnockFrame is the JSON response
+type RespKnockFrame struct {
+	FrameID string `json:"frame_id"`
+}
+
+// RespUpgradeFrame is the JSON response
+type RespUpgradeFrame struct {
+	ReplacementFrame string `json:"replacement_frame"`
+}
+
 // RespLeaveFrame is the JSON response
 type RespLeaveFrame struct{}
 
@@ -192,6 +242,9 @@ type RespSync struct {
 			Ephemeral struct {
 				Events []Event `json:"events"`
 			} `json:"ephemeral"`
+			Summary                   *FrameSummary                       `json:"summary,omitempty"`
+			UnreadNotifications       *UnreadNotificationCounts           `json:"unread_notifications,omitempty"`
+			UnreadThreadNotifications map[string]UnreadNotificationCounts `json:"unread_thread_notifications,omitempty"`
 		} `json:"join"`
 		Invite map[string]struct {
 			State struct {
@@ -0,0 +1,137 @@
+package xcore
+
+import (
+	"net"
+	"strings"
+)
+
+// ServerACLContent is the content of an m.frame.server_acl event. Servers matching Deny are denied, then
+// servers matching Allow are allowed, and all other servers are denied.
+type ServerACLContent struct {
+	Allow           []string `json:"allow,omitempty"`
+	Deny            []string `json:"deny,omitempty"`
+	AllowIPLiterals *bool    `json:"allow_ip_literals,omitempty"` // Defaults to true
+}
+
+// MatchGlob returns true if the string matches the glob pattern, where "*" matches zero or more characters
+// and "?" matches exactly one. Matching is case-insensitive.
+func MatchGlob(pattern, s string) bool {
+	// Match runes rather than bytes, so that "?" matches a whole non-ASCII character.
+	pat, str := []rune(strings.ToLower(pattern)), []rune(strings.ToLower(s))
+	p, i := 0, 0
+	star, starI := -1, 0 // the last "*" seen and the position in s it is currently matching up to
+	for i < len(str) {
+		switch {
+		case p < len(pat) && (pat[p] == '?' || pat[p] == str[i]):
+			p++
+			i++
+		case p < len(pat) && pat[p] == '*':
+			star, starI = p, i
+			p++
+		case star >= 0:
+			// backtrack: let the last "*" match one more character
+			starI++
+			p, i = star+1, starI
+		default:
+			return false
+		}
+	}
+	for p < len(pat) && pat[p] == '*' {
+		p++
+	}
+	return p == len(pat)
+}
+
+// isIPLiteral returns true if the host is an IPv4 address or a bracketed IPv6 address.
+func isIPLiteral(host string) bool {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return net.ParseIP(host[1:len(host)-1]) != nil
+	}
+	return net.ParseIP(host) != nil
+}
+
+// serverHost returns the server name without its port, if any.
+func serverHost(serverName string) string {
+	if strings.HasPrefix(serverName, "[") {
+		if end := strings.Index(serverName, "]"); end >= 0 {
+			return serverName[:end+1]
+		}
+		return serverName
+	}
+	if i := strings.LastIndexByte(serverName, ':'); i >= 0 {
+		return serverName[:i]
+	}
+	return serverName
+}
+
+// IsServerAllowed returns true if the ACL allows the given server. The port of the server name is ignored.
+func (c *ServerACLContent) IsServerAllowed(serverName string) bool {
+	host := serverHost(serverName)
+	if c.AllowIPLiterals != nil && !*c.AllowIPLiterals && isIPLiteral(host) {
+		return false
+	}
+	for _, pattern := range c.Deny {
+		if MatchGlob(pattern, host) {
+			return false
+		}
+	}
+	for _, pattern := range c.Allow {
+		if MatchGlob(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerACL returns the content of the m.frame.server_acl event, or nil if the frame has no ACL.
+func (s *FrameState) ServerACL() *ServerACLContent {
+	event := s.GetStateEvent("m.frame.server_acl", "")
+	if event == nil {
+		return nil
+	}
+	var content ServerACLContent
+	if err := event.ParseContent(&content); err != nil {
+		return nil
+	}
+	return &content
+}
+
+// IsServerAllowed returns true if the frame's ACL allows the given server. All servers are allowed in frames
+// without an ACL.
+func (s *FrameState) IsServerAllowed(serverName string) bool {
+	acl := s.ServerACL()
+	return acl == nil || acl.IsServerAllowed(serverName)
+}
+
+// DeniedMembers returns the joined, invited and knocking members whose servers are denied by the frame's ACL.
+func (s *FrameState) DeniedMembers() []Member {
+	acl := s.ServerACL()
+	if acl == nil {
+		return nil
+	}
+	var denied []Member
+	for _, member := range s.Members("") {
+		switch member.Membership {
+		case MembershipJoin, MembershipInvite, MembershipKnock:
+			if !acl.IsServerAllowed(serverName(member.UserID)) {
+				denied = append(denied, member)
+			}
+		}
+	}
+	return denied
+}
+
+// ServerACL returns the content of the frame's current m.frame.server_acl event, or nil if it has no ACL.
+func (frame *Frame) ServerACL() *ServerACLContent {
+	return frame.Snapshot().ServerACL()
+}
+
+// IsServerAllowed returns true if the frame's current ACL allows the given server.
+func (frame *Frame) IsServerAllowed(serverName string) bool {
+	return frame.Snapshot().IsServerAllowed(serverName)
+}
+
+// DeniedMembers returns the current members of the frame whose servers are denied by its ACL.
+func (frame *Frame) DeniedMembers() []Member {
+	return frame.Snapshot().DeniedMembers()
+}
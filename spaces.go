@@ -0,0 +1,224 @@
+package xcore
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// FrameTypeSpace is the type in the m.frame.create content of frames which are spaces.
+const FrameTypeSpace = "m.space"
+
+// maxSpaceOrderLength is the maximum length of the order of a space child.
+const maxSpaceOrderLength = 50
+
+// SpaceChildContent is the content of an m.space.child event, whose state key is the ID of the child frame.
+// Children without any via servers have been removed from the space.
+type SpaceChildContent struct {
+	Via       []string `json:"via,omitempty"`
+	Order     string   `json:"order,omitempty"`
+	Suggested bool     `json:"suggested,omitempty"`
+}
+
+// SpaceParentContent is the content of an m.space.parent event, whose state key is the ID of the parent space.
+type SpaceParentContent struct {
+	Via       []string `json:"via,omitempty"`
+	Canonical bool     `json:"canonical,omitempty"`
+}
+
+// SpaceChild is a child of a space.
+type SpaceChild struct {
+	FrameID string
+	SpaceChildContent
+	Timestamp int64 // The origin_server_ts of the m.space.child event, used for ordering
+}
+
+// SpaceParent is a parent space of a frame.
+type SpaceParent struct {
+	FrameID string
+	SpaceParentContent
+}
+
+// isValidSpaceOrder returns true if the order is at most 50 printable ASCII characters.
+func isValidSpaceOrder(order string) bool {
+	if len(order) > maxSpaceOrderLength {
+		return false
+	}
+	for i := 0; i < len(order); i++ {
+		if order[i] < 0x20 || order[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSpace returns true if the frame is a space.
+func (s *FrameState) IsSpace() bool {
+	create := s.Create()
+	return create != nil && create.Type == FrameTypeSpace
+}
+
+// SpaceChildren returns the children of the space, in the order given by the spec: children with a valid order
+// first, sorted by order, then the rest sorted by the timestamp of their m.space.child event, with the frame ID
+// breaking ties.
+func (s *FrameState) SpaceChildren() []SpaceChild {
+	var children []SpaceChild
+	for _, event := range s.EventsOfType("m.space.child") {
+		child := SpaceChild{FrameID: *event.StateKey, Timestamp: event.Timestamp}
+		if err := event.ParseContent(&child.SpaceChildContent); err != nil || len(child.Via) == 0 {
+			continue
+		}
+		if !isValidSpaceOrder(child.Order) {
+			child.Order = ""
+		}
+		children = append(children, child)
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+		if (a.Order != "") != (b.Order != "") {
+			return a.Order != ""
+		}
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+		return a.FrameID < b.FrameID
+	})
+	return children
+}
+
+// SpaceParents returns the parent spaces of the frame, sorted by frame ID.
+func (s *FrameState) SpaceParents() []SpaceParent {
+	var parents []SpaceParent
+	for _, event := range s.EventsOfType("m.space.parent") {
+		parent := SpaceParent{FrameID: *event.StateKey}
+		if err := event.ParseContent(&parent.SpaceParentContent); err != nil || len(parent.Via) == 0 {
+			continue
+		}
+		parents = append(parents, parent)
+	}
+	return parents
+}
+
+// IsSpace returns true if the frame is a space.
+func (frame *Frame) IsSpace() bool {
+	return frame.Snapshot().IsSpace()
+}
+
+// SpaceChildren returns the current children of the space. See FrameState.SpaceChildren.
+func (frame *Frame) SpaceChildren() []SpaceChild {
+	return frame.Snapshot().SpaceChildren()
+}
+
+// SpaceParents returns the current parent spaces of the frame.
+func (frame *Frame) SpaceParents() []SpaceParent {
+	return frame.Snapshot().SpaceParents()
+}
+
+// Hierarchy paginates over the frames in the space tree of the given frame, depth first. from is the next_batch
+// of a previous response. limit is the maximum number of frames to return, or 0 for the server default, and
+// maxDepth is how far to descend into the tree, or -1 for the server default.
+// See get-coddy-client-v1-frames-frameid-hierarchy
+func (cli *Client) Hierarchy(frameID, from string, limit, maxDepth int, suggestedOnly bool) (resp *RespHierarchy, err error) {
+	query := map[string]string{}
+	if from != "" {
+		query["from"] = from
+	}
+	if limit != 0 {
+		query["limit"] = strconv.Itoa(limit)
+	}
+	if maxDepth >= 0 {
+		query["max_depth"] = strconv.Itoa(maxDepth)
+	}
+	if suggestedOnly {
+		query["suggested_only"] = "true"
+	}
+	// The hierarchy endpoint only exists in v1 of the client API, so the r0 prefix can't be used.
+	u, _ := url.Parse(cli.BuildBaseURL("_coddy", "client", "v1", "frames", frameID, "hierarchy"))
+	q := u.Query()
+	for k, v := range query {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+	err = cli.MakeRequest("GET", u.String(), nil, &resp)
+	return
+}
+
+// AddSpaceChild adds the child frame to the space, or updates it if it is already a child. via are the servers
+// to join the child through, and must not be empty. order is an optional sort key of at most 50 printable ASCII
+// characters.
+func (cli *Client) AddSpaceChild(spaceID, childID string, via []string, order string, suggested bool) (*RespSendEvent, error) {
+	if len(via) == 0 {
+		return nil, errors.New("space children must have at least one via server")
+	}
+	if !isValidSpaceOrder(order) {
+		return nil, errors.New("space child order must be at most 50 printable ASCII characters")
+	}
+	return cli.SendStateEvent(spaceID, "m.space.child", childID, &SpaceChildContent{
+		Via:       via,
+		Order:     order,
+		Suggested: suggested,
+	})
+}
+
+// RemoveSpaceChild removes the child frame from the space.
+func (cli *Client) RemoveSpaceChild(spaceID, childID string) (*RespSendEvent, error) {
+	return cli.SendStateEvent(spaceID, "m.space.child", childID, &SpaceChildContent{})
+}
+
+// SpaceCycle is a loop in a space tree. The first and last frame IDs are the same.
+type SpaceCycle []string
+
+// WalkSpace walks the tree of the given space depth first, using the frames in the store. visit is called once
+// for each frame in the tree, including the space itself, with its depth below the space. Children of frames for
+// which visit returns false are skipped, as are children of frames which aren't in the store. Frames reachable
+// by more than one path are only visited the first time they are reached.
+//
+// Returns the cycles found in the tree; each cycle is reported once, at the child which would close the loop.
+func WalkSpace(store Storer, spaceID string, visit func(frameID string, depth int) bool) []SpaceCycle {
+	var cycles []SpaceCycle
+	visited := make(map[string]bool)
+	onPath := make(map[string]bool)
+	var path []string
+	var walk func(frameID string)
+	walk = func(frameID string) {
+		visited[frameID] = true
+		if !visit(frameID, len(path)) {
+			return
+		}
+		frame := store.LoadFrame(frameID)
+		if frame == nil {
+			return
+		}
+		path = append(path, frameID)
+		onPath[frameID] = true
+		for _, child := range frame.SpaceChildren() {
+			if onPath[child.FrameID] {
+				cycles = append(cycles, spaceCycle(path, child.FrameID))
+				continue
+			}
+			if !visited[child.FrameID] {
+				walk(child.FrameID)
+			}
+		}
+		onPath[frameID] = false
+		path = path[:len(path)-1]
+	}
+	walk(spaceID)
+	return cycles
+}
+
+// spaceCycle returns the cycle formed by going from the end of path back to frameID, which is on the path.
+func spaceCycle(path []string, frameID string) SpaceCycle {
+	for i, id := range path {
+		if id == frameID {
+			cycle := make(SpaceCycle, 0, len(path)-i+1)
+			cycle = append(cycle, path[i:]...)
+			return append(cycle, frameID)
+		}
+	}
+	return nil
+}
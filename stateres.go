@@ -0,0 +1,470 @@
+package xcore
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// StateMap is the state of a frame at some point, as a map from type and state key to event ID.
+type StateMap map[StateKeyTuple]string
+
+// EventFetcher fetches the events needed for state resolution. FetchEvent returns ErrEventNotFound, or an error
+// wrapping it, if the event isn't known.
+type EventFetcher interface {
+	FetchEvent(eventID string) (*PDU, error)
+}
+
+// ErrEventNotFound is returned by an EventFetcher when it doesn't have the requested event.
+var ErrEventNotFound = errors.New("event not found")
+
+// PDUMap is an EventFetcher for a fixed set of events keyed by event ID, e.g test fixtures.
+type PDUMap map[string]*PDU
+
+// FetchEvent returns the event with the given ID.
+func (m PDUMap) FetchEvent(eventID string) (*PDU, error) {
+	if pdu, ok := m[eventID]; ok {
+		return pdu, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrEventNotFound, eventID)
+}
+
+// ResolveState resolves the given state sets into a single state using version 2 of the state resolution
+// algorithm, which is used by frame versions 2 and later. Events referenced by the state sets and their auth
+// chains are fetched from the fetcher.
+func ResolveState(frameVersion string, stateSets []StateMap, fetcher EventFetcher) (StateMap, error) {
+	rules, err := GetFrameVersionRules(frameVersion)
+	if err != nil {
+		return nil, err
+	}
+	if !rules.StateResV2 {
+		return nil, fmt.Errorf("frame version %s does not use state resolution v2", frameVersion)
+	}
+	r := &stateResolver{
+		frameVersion: frameVersion,
+		fetcher:      fetcher,
+		events:       make(map[string]*PDU),
+	}
+	return r.resolve(stateSets)
+}
+
+// stateResolver holds the state of a single run of state resolution.
+type stateResolver struct {
+	frameVersion string
+	fetcher      EventFetcher
+	events       map[string]*PDU // events fetched so far, by ID
+}
+
+func (r *stateResolver) fetch(eventID string) (*PDU, error) {
+	if pdu, ok := r.events[eventID]; ok {
+		return pdu, nil
+	}
+	pdu, err := r.fetcher.FetchEvent(eventID)
+	if err != nil {
+		return nil, err
+	}
+	r.events[eventID] = pdu
+	return pdu, nil
+}
+
+func (r *stateResolver) resolve(stateSets []StateMap) (StateMap, error) {
+	unconflicted, conflicted := separateState(stateSets)
+	if len(conflicted) == 0 {
+		return unconflicted, nil
+	}
+
+	// The full conflicted set is the conflicted events plus the auth difference of the state sets.
+	fullConflicted := make(map[string]bool)
+	for _, eventIDs := range conflicted {
+		for _, eventID := range eventIDs {
+			fullConflicted[eventID] = true
+		}
+	}
+	authDifference, err := r.authDifference(stateSets)
+	if err != nil {
+		return nil, err
+	}
+	for eventID := range authDifference {
+		fullConflicted[eventID] = true
+	}
+
+	// Resolve the power events first, in reverse topological power ordering, along with the events in their
+	// auth chains which are also in the full conflicted set.
+	powerEvents := make(map[string]bool)
+	for eventID := range fullConflicted {
+		event, err := r.fetch(eventID)
+		if err != nil {
+			return nil, err
+		}
+		if isPowerEvent(event) {
+			if err = r.addPowerEvent(eventID, fullConflicted, powerEvents); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sortedPower, err := r.reverseTopologicalPowerSort(powerEvents)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := r.iterativeAuthChecks(sortedPower, copyStateMap(unconflicted))
+	if err != nil {
+		return nil, err
+	}
+
+	// Then resolve the remaining events in mainline order, based on the resolved power levels.
+	var others []string
+	for eventID := range fullConflicted {
+		if !powerEvents[eventID] {
+			others = append(others, eventID)
+		}
+	}
+	sortedOthers, err := r.mainlineSort(others, resolved[StateKeyTuple{"m.frame.power_levels", ""}])
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err = r.iterativeAuthChecks(sortedOthers, resolved); err != nil {
+		return nil, err
+	}
+
+	// Finally the unconflicted state takes precedence.
+	for key, eventID := range unconflicted {
+		resolved[key] = eventID
+	}
+	return resolved, nil
+}
+
+// separateState splits the state sets into the state which is the same in all of them, and the event IDs for
+// each key which differs between them, including keys which are missing from some sets.
+func separateState(stateSets []StateMap) (StateMap, map[StateKeyTuple][]string) {
+	unconflicted := make(StateMap)
+	conflicted := make(map[StateKeyTuple][]string)
+	keys := make(map[StateKeyTuple]bool)
+	for _, stateSet := range stateSets {
+		for key := range stateSet {
+			keys[key] = true
+		}
+	}
+	for key := range keys {
+		var eventIDs []string
+		same := true
+		for i, stateSet := range stateSets {
+			eventID, exists := stateSet[key]
+			if !exists || (i > 0 && eventID != stateSets[0][key]) {
+				same = false
+			}
+			if exists && !containsString(eventIDs, eventID) {
+				eventIDs = append(eventIDs, eventID)
+			}
+		}
+		if same {
+			unconflicted[key] = eventIDs[0]
+		} else {
+			conflicted[key] = eventIDs
+		}
+	}
+	return unconflicted, conflicted
+}
+
+// authChain returns the IDs of all the events in the auth chains of the given events, not including the events
+// themselves unless they are in the auth chain of another of the events.
+func (r *stateResolver) authChain(eventIDs []string) (map[string]bool, error) {
+	chain := make(map[string]bool)
+	var todo []string
+	for _, eventID := range eventIDs {
+		event, err := r.fetch(eventID)
+		if err != nil {
+			return nil, err
+		}
+		todo = append(todo, event.AuthEventIDs()...)
+	}
+	for len(todo) > 0 {
+		eventID := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if chain[eventID] {
+			continue
+		}
+		chain[eventID] = true
+		event, err := r.fetch(eventID)
+		if err != nil {
+			return nil, err
+		}
+		todo = append(todo, event.AuthEventIDs()...)
+	}
+	return chain, nil
+}
+
+// authDifference returns the events which are in the auth chains of some of the state sets, but not all.
+func (r *stateResolver) authDifference(stateSets []StateMap) (map[string]bool, error) {
+	counts := make(map[string]int)
+	for _, stateSet := range stateSets {
+		eventIDs := make([]string, 0, len(stateSet))
+		for _, eventID := range stateSet {
+			eventIDs = append(eventIDs, eventID)
+		}
+		chain, err := r.authChain(eventIDs)
+		if err != nil {
+			return nil, err
+		}
+		for eventID := range chain {
+			counts[eventID]++
+		}
+	}
+	difference := make(map[string]bool)
+	for eventID, count := range counts {
+		if count < len(stateSets) {
+			difference[eventID] = true
+		}
+	}
+	return difference, nil
+}
+
+// isPowerEvent returns true for events which change who can do what in the frame: power levels, join rules,
+// the create event, and kicks and bans.
+func isPowerEvent(event *PDU) bool {
+	if event.StateKey == nil {
+		return false
+	}
+	switch event.Type {
+	case "m.frame.power_levels", "m.frame.join_rules", "m.frame.create":
+		return *event.StateKey == ""
+	case "m.frame.member":
+		membership, _ := event.Content["membership"].(string)
+		return (membership == MembershipLeave || membership == MembershipBan) && *event.StateKey != event.Sender
+	}
+	return false
+}
+
+// addPowerEvent adds the event and the events in its auth chain which are in the full conflicted set to
+// powerEvents.
+func (r *stateResolver) addPowerEvent(eventID string, fullConflicted, powerEvents map[string]bool) error {
+	if powerEvents[eventID] {
+		return nil
+	}
+	powerEvents[eventID] = true
+	event, err := r.fetch(eventID)
+	if err != nil {
+		return err
+	}
+	for _, authID := range event.AuthEventIDs() {
+		if fullConflicted[authID] {
+			if err = r.addPowerEvent(authID, fullConflicted, powerEvents); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// senderPowerLevel returns the power level of the sender of the event, according to its auth events.
+func (r *stateResolver) senderPowerLevel(event *PDU) (int64, error) {
+	authEvents := make(AuthEvents)
+	for _, authID := range event.AuthEventIDs() {
+		authEvent, err := r.fetch(authID)
+		if err != nil {
+			return 0, err
+		}
+		authEvents.Add(authEvent)
+	}
+	pl, err := authEvents.PowerLevels()
+	if err != nil {
+		// Invalid power levels would have been rejected, so treat the sender as having no power.
+		return 0, nil
+	}
+	return pl.UserLevel(event.Sender), nil
+}
+
+// sortableEvent is an event with the keys used to order it.
+type sortableEvent struct {
+	eventID  string
+	primary  int64 // negative sender power level, or mainline position
+	originTS int64
+}
+
+func (a sortableEvent) less(b sortableEvent) bool {
+	if a.primary != b.primary {
+		return a.primary < b.primary
+	}
+	if a.originTS != b.originTS {
+		return a.originTS < b.originTS
+	}
+	return a.eventID < b.eventID
+}
+
+// eventHeap is a min-heap of sortableEvents.
+type eventHeap []sortableEvent
+
+func (h eventHeap) Len() int            { return len(h) }
+func (h eventHeap) Less(i, j int) bool  { return h[i].less(h[j]) }
+func (h eventHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *eventHeap) Push(x interface{}) { *h = append(*h, x.(sortableEvent)) }
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// reverseTopologicalPowerSort orders the events so that each event comes after the events in its auth events,
+// breaking ties by the highest sender power level, then the earliest origin_server_ts, then the lowest event ID.
+func (r *stateResolver) reverseTopologicalPowerSort(eventIDs map[string]bool) ([]string, error) {
+	nodes := make(map[string]sortableEvent, len(eventIDs))
+	waitingOn := make(map[string]int, len(eventIDs))       // number of unsorted auth events of each event
+	dependents := make(map[string][]string, len(eventIDs)) // events which have each event as an auth event
+	for eventID := range eventIDs {
+		event, err := r.fetch(eventID)
+		if err != nil {
+			return nil, err
+		}
+		level, err := r.senderPowerLevel(event)
+		if err != nil {
+			return nil, err
+		}
+		node := sortableEvent{eventID: eventID, primary: -level, originTS: event.OriginServerTS}
+		for _, authID := range event.AuthEventIDs() {
+			if eventIDs[authID] {
+				waitingOn[eventID]++
+				dependents[authID] = append(dependents[authID], eventID)
+			}
+		}
+		nodes[eventID] = node
+	}
+
+	var ready eventHeap
+	for eventID, node := range nodes {
+		if waitingOn[eventID] == 0 {
+			ready = append(ready, node)
+		}
+	}
+	heap.Init(&ready)
+	sorted := make([]string, 0, len(nodes))
+	for ready.Len() > 0 {
+		node := heap.Pop(&ready).(sortableEvent)
+		sorted = append(sorted, node.eventID)
+		for _, dependent := range dependents[node.eventID] {
+			waitingOn[dependent]--
+			if waitingOn[dependent] == 0 {
+				heap.Push(&ready, nodes[dependent])
+			}
+		}
+	}
+	if len(sorted) != len(nodes) {
+		return nil, errors.New("auth events contain a cycle")
+	}
+	return sorted, nil
+}
+
+// powerLevelsAuthEvent returns the ID of the m.frame.power_levels event in the auth events of the event, or "".
+func (r *stateResolver) powerLevelsAuthEvent(event *PDU) (string, error) {
+	for _, authID := range event.AuthEventIDs() {
+		authEvent, err := r.fetch(authID)
+		if err != nil {
+			return "", err
+		}
+		if authEvent.Type == "m.frame.power_levels" && authEvent.StateKey != nil && *authEvent.StateKey == "" {
+			return authID, nil
+		}
+	}
+	return "", nil
+}
+
+// mainlineSort orders the events by the position of their closest power levels ancestor in the mainline of
+// the given power levels event, then by origin_server_ts, then by event ID. Events with no ancestor in the
+// mainline come first.
+func (r *stateResolver) mainlineSort(eventIDs []string, powerLevelsID string) ([]string, error) {
+	// The mainline is the chain of power levels events starting at powerLevelsID, oldest first.
+	var mainline []string
+	seen := make(map[string]bool)
+	for eventID := powerLevelsID; eventID != "" && !seen[eventID]; {
+		seen[eventID] = true
+		mainline = append(mainline, eventID)
+		event, err := r.fetch(eventID)
+		if err != nil {
+			return nil, err
+		}
+		if eventID, err = r.powerLevelsAuthEvent(event); err != nil {
+			return nil, err
+		}
+	}
+	positions := make(map[string]int64, len(mainline))
+	for i, eventID := range mainline {
+		positions[eventID] = int64(len(mainline) - i)
+	}
+
+	nodes := make([]sortableEvent, len(eventIDs))
+	for i, eventID := range eventIDs {
+		event, err := r.fetch(eventID)
+		if err != nil {
+			return nil, err
+		}
+		var position int64
+		visited := make(map[string]bool)
+		for ancestor := event; ancestor != nil; {
+			plID, err := r.powerLevelsAuthEvent(ancestor)
+			if err != nil {
+				return nil, err
+			}
+			if plID == "" || visited[plID] {
+				break
+			}
+			visited[plID] = true
+			if pos, ok := positions[plID]; ok {
+				position = pos
+				break
+			}
+			if ancestor, err = r.fetch(plID); err != nil {
+				return nil, err
+			}
+		}
+		nodes[i] = sortableEvent{eventID: eventID, primary: position, originTS: event.OriginServerTS}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].less(nodes[j]) })
+	sorted := make([]string, len(nodes))
+	for i, node := range nodes {
+		sorted[i] = node.eventID
+	}
+	return sorted, nil
+}
+
+// iterativeAuthChecks applies each event to the state in order if it is allowed by the auth events it cites,
+// overridden by the current state.
+func (r *stateResolver) iterativeAuthChecks(eventIDs []string, state StateMap) (StateMap, error) {
+	for _, eventID := range eventIDs {
+		event, err := r.fetch(eventID)
+		if err != nil {
+			return nil, err
+		}
+		if event.StateKey == nil {
+			continue
+		}
+		authEvents := make(AuthEvents)
+		for _, authID := range event.AuthEventIDs() {
+			authEvent, err := r.fetch(authID)
+			if err != nil {
+				return nil, err
+			}
+			authEvents.Add(authEvent)
+		}
+		for _, key := range AuthTypes(event) {
+			if stateID, ok := state[key]; ok {
+				stateEvent, err := r.fetch(stateID)
+				if err != nil {
+					return nil, err
+				}
+				authEvents.Add(stateEvent)
+			}
+		}
+		if CheckEventAuth(r.frameVersion, event, authEvents) == nil {
+			state[StateKeyTuple{event.Type, *event.StateKey}] = eventID
+		}
+	}
+	return state, nil
+}
+
+func copyStateMap(state StateMap) StateMap {
+	copied := make(StateMap, len(state))
+	for key, eventID := range state {
+		copied[key] = eventID
+	}
+	return copied
+}
@@ -0,0 +1,67 @@
+package xcore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stateResFixture is a state resolution case in testdata/stateres. State maps are lists of
+// [type, state_key, event_id] entries.
+type stateResFixture struct {
+	Description  string          `json:"description"`
+	FrameVersion string          `json:"frame_version"`
+	Events       map[string]*PDU `json:"events"`
+	StateSets    [][][3]string   `json:"state_sets"`
+	Expected     [][3]string     `json:"expected"`
+}
+
+func fixtureStateMap(entries [][3]string) StateMap {
+	state := make(StateMap, len(entries))
+	for _, entry := range entries {
+		state[StateKeyTuple{entry[0], entry[1]}] = entry[2]
+	}
+	return state
+}
+
+func TestResolveStateFixtures(t *testing.T) {
+	paths, err := filepath.Glob("testdata/stateres/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no state resolution fixtures found")
+	}
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fixture stateResFixture
+			if err = json.Unmarshal(data, &fixture); err != nil {
+				t.Fatal(err)
+			}
+			var stateSets []StateMap
+			for _, entries := range fixture.StateSets {
+				stateSets = append(stateSets, fixtureStateMap(entries))
+			}
+			resolved, err := ResolveState(fixture.FrameVersion, stateSets, PDUMap(fixture.Events))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := fixtureStateMap(fixture.Expected)
+			for key, eventID := range expected {
+				if resolved[key] != eventID {
+					t.Errorf("%s: %s (%q) resolved to %q, want %q", fixture.Description, key.EventType, key.StateKey, resolved[key], eventID)
+				}
+			}
+			for key, eventID := range resolved {
+				if _, ok := expected[key]; !ok {
+					t.Errorf("%s: unexpected %s (%q) = %q", fixture.Description, key.EventType, key.StateKey, eventID)
+				}
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package xcore
 
+import "sync"
+
 // Storer is an interface which must be satisfied to store client data.
 //
 // You can either write a struct which persists this data to disk, or you can use the
@@ -18,11 +20,16 @@ type Storer interface {
 //
 // Everything is persisted in-memory as maps. It is not safe to load/save filter IDs
 // or next batch tokens on any goroutine other than the syncing goroutine: the one
-// which called Client.Sync().
+// which called Client.Sync(). Frames may be loaded on any goroutine, and the Frame
+// state is safe for concurrent use.
 type InMemoryStore struct {
 	Filters   map[string]string
 	NextBatch map[string]string
-	Frames     map[string]*Frame
+	Frames    map[string]*Frame
+	Events    map[string]*PDU // Federation events by ID, used as an EventFetcher for state resolution
+
+	framesMu sync.RWMutex
+	eventsMu sync.RWMutex
 }
 
 // SaveFilterID to memory.
@@ -47,19 +54,38 @@ func (s *InMemoryStore) LoadNextBatch(userID string) string {
 
 // SaveFrame to memory.
 func (s *InMemoryStore) SaveFrame(frame *Frame) {
+	s.framesMu.Lock()
+	defer s.framesMu.Unlock()
 	s.Frames[frame.ID] = frame
 }
 
 // LoadFrame from memory.
 func (s *InMemoryStore) LoadFrame(frameID string) *Frame {
+	s.framesMu.RLock()
+	defer s.framesMu.RUnlock()
 	return s.Frames[frameID]
 }
 
+// SaveEvent to memory, so that it can be fetched by FetchEvent.
+func (s *InMemoryStore) SaveEvent(eventID string, event *PDU) {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	s.Events[eventID] = event
+}
+
+// FetchEvent from memory. Together with SaveEvent this lets an InMemoryStore be used as an EventFetcher.
+func (s *InMemoryStore) FetchEvent(eventID string) (*PDU, error) {
+	s.eventsMu.RLock()
+	defer s.eventsMu.RUnlock()
+	return PDUMap(s.Events).FetchEvent(eventID)
+}
+
 // NewInMemoryStore constructs a new InMemoryStore.
 func NewInMemoryStore() *InMemoryStore {
 	return &InMemoryStore{
 		Filters:   make(map[string]string),
 		NextBatch: make(map[string]string),
-		Frames:     make(map[string]*Frame),
+		Frames:    make(map[string]*Frame),
+		Events:    make(map[string]*PDU),
 	}
 }
@@ -0,0 +1,115 @@
+package xcore
+
+import "sync"
+
+// FrameSummary is the summary of a joined frame from /sync, used to name frames without the full member list.
+// Fields which haven't changed since the last sync are omitted by the server, so they are nil in responses.
+type FrameSummary struct {
+	Heroes             []string `json:"m.heroes,omitempty"`
+	JoinedMemberCount  *int     `json:"m.joined_member_count,omitempty"`
+	InvitedMemberCount *int     `json:"m.invited_member_count,omitempty"`
+}
+
+// UnreadNotificationCounts are the numbers of unread notifications, and of those how many are highlights.
+type UnreadNotificationCounts struct {
+	NotificationCount int `json:"notification_count"`
+	HighlightCount    int `json:"highlight_count"`
+}
+
+// FrameCounts are the member counts and unread notification counts of a frame, as last seen in /sync.
+type FrameCounts struct {
+	Heroes             []string
+	JoinedMemberCount  int
+	InvitedMemberCount int
+	Unread             UnreadNotificationCounts
+	ThreadUnread       map[string]UnreadNotificationCounts // Thread root event ID to counts, for threads with unread notifications
+}
+
+// frameCounts holds the FrameCounts of a Frame.
+type frameCounts struct {
+	mu     sync.Mutex
+	counts FrameCounts
+}
+
+// FrameCountsListener can be used with DefaultSyncer.OnFrameCounts to be informed when the counts of a frame
+// change.
+type FrameCountsListener func(frameID string, counts FrameCounts)
+
+// Counts returns the member and unread notification counts of the frame.
+func (frame *Frame) Counts() FrameCounts {
+	frame.counts.mu.Lock()
+	defer frame.counts.mu.Unlock()
+	return frame.counts.counts.copy()
+}
+
+func (c FrameCounts) copy() FrameCounts {
+	c.Heroes = append([]string(nil), c.Heroes...)
+	threads := make(map[string]UnreadNotificationCounts, len(c.ThreadUnread))
+	for threadID, counts := range c.ThreadUnread {
+		threads[threadID] = counts
+	}
+	c.ThreadUnread = threads
+	return c
+}
+
+// updateCounts merges the counts from a /sync response into the frame, returning the new counts and whether
+// they changed. summary, unread and threadUnread are nil if they weren't in the response. The server leaves out
+// threads without notifications, so threadUnread replaces all the thread counts when it is present.
+func (frame *Frame) updateCounts(summary *FrameSummary, unread *UnreadNotificationCounts, threadUnread map[string]UnreadNotificationCounts) (FrameCounts, bool) {
+	frame.counts.mu.Lock()
+	defer frame.counts.mu.Unlock()
+	c := &frame.counts.counts
+	changed := false
+	if summary != nil {
+		if summary.Heroes != nil && !equalStrings(summary.Heroes, c.Heroes) {
+			c.Heroes = append([]string(nil), summary.Heroes...)
+			changed = true
+		}
+		if summary.JoinedMemberCount != nil && *summary.JoinedMemberCount != c.JoinedMemberCount {
+			c.JoinedMemberCount = *summary.JoinedMemberCount
+			changed = true
+		}
+		if summary.InvitedMemberCount != nil && *summary.InvitedMemberCount != c.InvitedMemberCount {
+			c.InvitedMemberCount = *summary.InvitedMemberCount
+			changed = true
+		}
+	}
+	if unread != nil && *unread != c.Unread {
+		c.Unread = *unread
+		changed = true
+	}
+	if threadUnread != nil && !equalThreadCounts(threadUnread, c.ThreadUnread) {
+		c.ThreadUnread = make(map[string]UnreadNotificationCounts, len(threadUnread))
+		for threadID, counts := range threadUnread {
+			if counts != (UnreadNotificationCounts{}) {
+				c.ThreadUnread[threadID] = counts
+			}
+		}
+		changed = true
+	}
+	return c.copy(), changed
+}
+
+// equalThreadCounts returns true if the thread counts are the same, ignoring threads without notifications.
+func equalThreadCounts(a, b map[string]UnreadNotificationCounts) bool {
+	for _, pair := range [][2]map[string]UnreadNotificationCounts{{a, b}, {b, a}} {
+		for threadID, counts := range pair[0] {
+			if pair[1][threadID] != counts {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -25,7 +25,11 @@ type Syncer interface {
 type DefaultSyncer struct {
 	UserID    string
 	Store     Storer
+	Pending   *PendingEvents               // If set, timeline events are matched against events sent by this client. May be nil.
 	listeners map[string][]OnEventListener // event type to listeners array
+
+	upgradeListeners []FrameUpgradeListener
+	countsListeners  []FrameCountsListener
 }
 
 // OnEventListener can be used with DefaultSyncer.OnEventType to be informed of incoming events.
@@ -42,10 +46,13 @@ func NewDefaultSyncer(userID string, store Storer) *DefaultSyncer {
 
 // ProcessResponse processes the /sync response in a way suitable for bots. "Suitable for bots" means a stream of
 // unrepeating events. Returns a fatal error if a listener panics.
+//
+// The state of joined and left frames is updated from both the state block and the state events in the timeline,
+// so that the stored state is current after each sync. Upgrade listeners are also notified of tombstones in
+// frames which are otherwise skipped because they were just joined, but not of tombstones in the first sync.
 func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error) {
-	if !s.shouldProcessResponse(res, since) {
-		return
-	}
+	// Find the tombstones first, as shouldProcessResponse may remove the frames they are in.
+	tombstones := joinedTombstones(res)
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -53,6 +60,14 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 		}
 	}()
 
+	if !s.shouldProcessResponse(res, since) {
+		// Tombstones in the first sync are history rather than new upgrades.
+		if since != "" {
+			s.notifyUpgrades(tombstones)
+		}
+		return
+	}
+
 	for frameID, frameData := range res.Frames.Join {
 		frame := s.getOrCreateFrame(frameID)
 		for _, event := range frameData.State.Events {
@@ -60,9 +75,22 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 			frame.UpdateState(&event)
 			s.notifyListeners(&event)
 		}
-		for _, event := range frameData.Timeline.Events {
+		for i := range frameData.Timeline.Events {
+			event := &frameData.Timeline.Events[i]
 			event.FrameID = frameID
-			s.notifyListeners(&event)
+			if event.StateKey != nil {
+				frame.UpdateState(event)
+			}
+			if s.Pending != nil {
+				s.Pending.Match(event)
+			}
+			s.notifyListeners(event)
+		}
+		frame.Timeline().AppendSync(frameData.Timeline.Events, frameData.Timeline.Limited, frameData.Timeline.PrevBatch)
+		if counts, changed := frame.updateCounts(frameData.Summary, frameData.UnreadNotifications, frameData.UnreadThreadNotifications); changed {
+			for _, fn := range s.countsListeners {
+				fn(frameID, counts)
+			}
 		}
 		for _, event := range frameData.Ephemeral.Events {
 			event.FrameID = frameID
@@ -79,14 +107,17 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 	}
 	for frameID, frameData := range res.Frames.Leave {
 		frame := s.getOrCreateFrame(frameID)
-		for _, event := range frameData.Timeline.Events {
+		for i := range frameData.Timeline.Events {
+			event := &frameData.Timeline.Events[i]
+			event.FrameID = frameID
 			if event.StateKey != nil {
-				event.FrameID = frameID
-				frame.UpdateState(&event)
-				s.notifyListeners(&event)
+				frame.UpdateState(event)
+				s.notifyListeners(event)
 			}
 		}
+		frame.Timeline().AppendSync(frameData.Timeline.Events, frameData.Timeline.Limited, frameData.Timeline.PrevBatch)
 	}
+	s.notifyUpgrades(tombstones)
 	return
 }
 
@@ -100,6 +131,49 @@ func (s *DefaultSyncer) OnEventType(eventType string, callback OnEventListener)
 	s.listeners[eventType] = append(s.listeners[eventType], callback)
 }
 
+// OnFrameUpgrade allows callers to be notified when a joined frame is replaced by a new frame, i.e when an
+// m.frame.tombstone event is received.
+func (s *DefaultSyncer) OnFrameUpgrade(callback FrameUpgradeListener) {
+	s.upgradeListeners = append(s.upgradeListeners, callback)
+}
+
+// OnFrameCounts allows callers to be notified when the member counts or unread notification counts of a joined
+// frame change.
+func (s *DefaultSyncer) OnFrameCounts(callback FrameCountsListener) {
+	s.countsListeners = append(s.countsListeners, callback)
+}
+
+// joinedTombstones returns the latest m.frame.tombstone event in the state or timeline of each joined frame in
+// the response.
+func joinedTombstones(res *RespSync) map[string]*Event {
+	tombstones := make(map[string]*Event)
+	for frameID, frameData := range res.Frames.Join {
+		for _, events := range [][]Event{frameData.State.Events, frameData.Timeline.Events} {
+			for i := range events {
+				if events[i].Type == "m.frame.tombstone" && events[i].StateKey != nil && *events[i].StateKey == "" {
+					event := events[i]
+					event.FrameID = frameID
+					tombstones[frameID] = &event
+				}
+			}
+		}
+	}
+	return tombstones
+}
+
+// notifyUpgrades notifies the upgrade listeners of the given tombstone events, by frame ID.
+func (s *DefaultSyncer) notifyUpgrades(tombstones map[string]*Event) {
+	for frameID, event := range tombstones {
+		var tombstone TombstoneContent
+		if err := event.ParseContent(&tombstone); err != nil || tombstone.ReplacementFrame == "" {
+			continue
+		}
+		for _, fn := range s.upgradeListeners {
+			fn(frameID, &tombstone, event)
+		}
+	}
+}
+
 // shouldProcessResponse returns true if the response should be processed. May modify the response to remove
 // stuff that shouldn't be processed.
 func (s *DefaultSyncer) shouldProcessResponse(resp *RespSync, since string) bool {
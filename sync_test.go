@@ -0,0 +1,54 @@
+package xcore
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestProcessResponseFrameUpgrade(t *testing.T) {
+	// The tombstone is followed by another event, and in the second frame the sync also contains our join, which
+	// makes shouldProcessResponse skip the frame.
+	const syncJSON = `{"next_batch":"s2","frames":{"join":{
+		"!old:example.org":{"timeline":{"events":[
+			{"type":"m.frame.tombstone","state_key":"","sender":"@alice:example.org","event_id":"$tomb1","content":{"replacement_frame":"!new:example.org"}},
+			{"type":"m.frame.message","sender":"@alice:example.org","event_id":"$msg1","content":{"msgtype":"m.text","body":"bye"}}
+		]}},
+		"!joined:example.org":{"timeline":{"events":[
+			{"type":"m.frame.member","state_key":"@bot:example.org","sender":"@bot:example.org","event_id":"$join","content":{"membership":"join"}},
+			{"type":"m.frame.tombstone","state_key":"","sender":"@alice:example.org","event_id":"$tomb2","content":{"replacement_frame":"!newer:example.org"}},
+			{"type":"m.frame.message","sender":"@alice:example.org","event_id":"$msg2","content":{"msgtype":"m.text","body":"bye"}}
+		]}}
+	}}}`
+
+	for _, tc := range []struct {
+		since    string
+		upgrades map[string]string
+	}{
+		{since: "s1", upgrades: map[string]string{"!old:example.org": "!new:example.org", "!joined:example.org": "!newer:example.org"}},
+		{since: "", upgrades: map[string]string{}},
+	} {
+		syncer := NewDefaultSyncer("@bot:example.org", NewInMemoryStore())
+		upgrades := make(map[string]string)
+		syncer.OnFrameUpgrade(func(frameID string, tombstone *TombstoneContent, event *Event) {
+			if event.Type != "m.frame.tombstone" || event.FrameID != frameID {
+				t.Errorf("since=%q: upgrade of %s reported with event %s in %s", tc.since, frameID, event.Type, event.FrameID)
+			}
+			upgrades[frameID] = tombstone.ReplacementFrame
+		})
+		var res RespSync
+		if err := json.Unmarshal([]byte(syncJSON), &res); err != nil {
+			t.Fatal(err)
+		}
+		if err := syncer.ProcessResponse(&res, tc.since); err != nil {
+			t.Fatal(err)
+		}
+		if len(upgrades) != len(tc.upgrades) {
+			t.Errorf("since=%q: got upgrades %v, want %v", tc.since, upgrades, tc.upgrades)
+		}
+		for frameID, replacement := range tc.upgrades {
+			if upgrades[frameID] != replacement {
+				t.Errorf("since=%q: %s upgraded to %q, want %q", tc.since, frameID, upgrades[frameID], replacement)
+			}
+		}
+	}
+}
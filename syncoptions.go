@@ -0,0 +1,67 @@
+package xcore
+
+import "time"
+
+// DefaultSyncTimeout is how long the server waits for new events before responding to a /sync, unless
+// SyncOptions.Timeout is set.
+const DefaultSyncTimeout = 30 * time.Second
+
+// NoSyncTimeout can be used as SyncOptions.Timeout to make the server respond to each /sync straight away,
+// without waiting for new events.
+const NoSyncTimeout time.Duration = -1
+
+// MaxCatchUpSyncs is the most syncs Client.Sync makes to catch up before long polling. See SyncOptions.CatchUp.
+const MaxCatchUpSyncs = 50
+
+// The values of SyncOptions.SetPresence.
+const (
+	PresenceOnline      = "online"
+	PresenceUnavailable = "unavailable"
+	PresenceOffline     = "offline"
+)
+
+// SyncOptions configures the requests made by Client.Sync. The zero value long polls for 30 seconds and leaves
+// the presence of the user unchanged.
+type SyncOptions struct {
+	// How long the server waits for new events before responding. Zero means DefaultSyncTimeout and
+	// NoSyncTimeout, or any negative duration, means not waiting. Timeouts are rounded up to a millisecond.
+	Timeout time.Duration
+	// The presence to set for the user while syncing: PresenceOnline, PresenceUnavailable or PresenceOffline.
+	// Empty means the server default, which is online.
+	SetPresence string
+	// If true, the first /sync of each call to Sync returns the full state of every frame, rather than only the
+	// changes since the stored next batch token. DefaultSyncer ignores the response to the first sync of a user,
+	// with no stored token, so this only has an effect with it when resuming from a stored token: the full
+	// state is then stored and its events are passed to the listeners again.
+	FullStateOnFirstSync bool
+	// If true, Sync catches up with the server before long polling: syncs are made with no timeout until a
+	// response has no frame updates or doesn't advance the next batch token, or MaxCatchUpSyncs have been made.
+	CatchUp bool
+	// If set, OnIteration is called after each /sync response has been processed. Returning an error stops
+	// syncing with that error.
+	OnIteration func(iteration *SyncIteration) error
+}
+
+// SyncIteration describes a /sync response which has been processed by Client.Sync.
+type SyncIteration struct {
+	Since      string    // The since token of the request, or "" for the first sync of the user
+	Response   *RespSync // The response, which has already been given to Client.Syncer
+	CatchingUp bool      // True if the request was made to catch up. See SyncOptions.CatchUp
+	CaughtUp   bool      // True if this response finished catching up
+}
+
+// timeout returns the long-poll timeout in milliseconds.
+func (opts *SyncOptions) timeout() int {
+	switch {
+	case opts.Timeout == 0:
+		return int(DefaultSyncTimeout / time.Millisecond)
+	case opts.Timeout < 0:
+		return 0
+	}
+	return int((opts.Timeout + time.Millisecond - 1) / time.Millisecond)
+}
+
+// hasFrameUpdates returns true if the /sync response contains any frames.
+func (resp *RespSync) hasFrameUpdates() bool {
+	return len(resp.Frames.Join) > 0 || len(resp.Frames.Invite) > 0 || len(resp.Frames.Leave) > 0
+}
@@ -0,0 +1,255 @@
+package xcore
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultMaxTimelineEvents is the number of events a Timeline keeps unless Timeline.SetMaxEvents is called.
+const DefaultMaxTimelineEvents = 1000
+
+// TimelineGap marks missing events in a Timeline, which can be fetched with Client.Backfill. Gaps are returned
+// by value, so they don't change when the timeline does.
+type TimelineGap struct {
+	ID        uint64 // Identifies the gap within its timeline
+	PrevBatch string // The token to paginate backwards from to fetch the missing events
+}
+
+// TimelineItem is an entry in a Timeline: either an event or a gap.
+type TimelineItem struct {
+	Event *Event
+	Gap   *TimelineGap
+
+	prevBatch string // For the oldest event of a /sync or /messages batch, the token to fetch the events before it
+}
+
+// Timeline is the ordered list of events in a frame, oldest first, as seen by /sync and backfilled with
+// /messages. When /sync skips events because the timeline was limited, a gap is recorded where the events are
+// missing. The timeline is safe for concurrent use.
+//
+// Only the most recent events are kept: once the timeline has more than its maximum number of events, the
+// oldest events and gaps are dropped when new events arrive from /sync, and a gap is left at the start of the
+// timeline so that the dropped history can be fetched again. The timeline is only cut where there is a token to
+// fetch the history from, so it may keep up to one batch of events more than its maximum.
+type Timeline struct {
+	mu        sync.Mutex
+	items     []TimelineItem
+	eventIDs  map[string]bool
+	nextGapID uint64
+	maxEvents int // 0 means DefaultMaxTimelineEvents, negative means no limit
+}
+
+// ErrNoTimelineGap is returned by Client.Backfill when the timeline of the frame has no gaps.
+var ErrNoTimelineGap = errors.New("the timeline has no gaps")
+
+// ErrTimelineGapChanged is returned by Timeline.FillGap when the gap has been filled from its PrevBatch token
+// since it was returned, e.g by a concurrent backfill.
+var ErrTimelineGapChanged = errors.New("the timeline gap has changed")
+
+// Timeline returns the timeline of the frame.
+func (frame *Frame) Timeline() *Timeline {
+	return &frame.timeline
+}
+
+// Items returns a copy of the items in the timeline, oldest first. The events must not be modified.
+func (t *Timeline) Items() []TimelineItem {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	items := make([]TimelineItem, len(t.items))
+	for i, item := range t.items {
+		items[i] = item
+		if item.Gap != nil {
+			gap := *item.Gap
+			items[i].Gap = &gap
+		}
+	}
+	return items
+}
+
+// SetMaxEvents sets the maximum number of events kept in the timeline. max <= 0 means the timeline is never
+// trimmed. The timeline is trimmed the next time events arrive from /sync.
+func (t *Timeline) SetMaxEvents(max int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if max <= 0 {
+		max = -1
+	}
+	t.maxEvents = max
+}
+
+// Events returns the events in the timeline, oldest first, skipping gaps. The events must not be modified.
+func (t *Timeline) Events() []*Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var events []*Event
+	for _, item := range t.items {
+		if item.Event != nil {
+			events = append(events, item.Event)
+		}
+	}
+	return events
+}
+
+// LatestGap returns the most recent gap in the timeline, or false if there are none.
+func (t *Timeline) LatestGap() (TimelineGap, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.items) - 1; i >= 0; i-- {
+		if t.items[i].Gap != nil {
+			return *t.items[i].Gap, true
+		}
+	}
+	return TimelineGap{}, false
+}
+
+// AppendSync adds the timeline events of a frame from /sync. If the timeline was limited, a gap is added before
+// the events for the events which were skipped, and the first events of a frame are preceded by a gap for the
+// frame's earlier history. Events which are already in the timeline are ignored. The timeline is then trimmed to
+// its maximum number of events.
+func (t *Timeline) AppendSync(events []Event, limited bool, prevBatch string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prevBatch != "" && (limited || len(t.items) == 0) {
+		t.nextGapID++
+		t.items = append(t.items, TimelineItem{Gap: &TimelineGap{ID: t.nextGapID, PrevBatch: prevBatch}})
+	}
+	for i := range events {
+		if t.addEvent(len(t.items), &events[i]) && i == 0 {
+			t.items[len(t.items)-1].prevBatch = prevBatch
+		}
+	}
+	t.trim()
+}
+
+// trim drops the oldest items until the timeline has at most its maximum number of events. The timeline is only
+// cut before a gap or before an event with a prevBatch token, which is then kept in a gap at the start of the
+// timeline, so that the dropped history can be backfilled.
+func (t *Timeline) trim() {
+	max := t.maxEvents
+	if max == 0 {
+		max = DefaultMaxTimelineEvents
+	} else if max < 0 {
+		return
+	}
+	count := 0
+	for _, item := range t.items {
+		if item.Event != nil {
+			count++
+		}
+	}
+	cut := 0
+	for ; count > max; cut++ {
+		if t.items[cut].Event != nil {
+			count--
+		}
+	}
+	for cut > 0 && t.items[cut].Gap == nil && t.items[cut].prevBatch == "" {
+		cut--
+	}
+	if cut > 0 && t.items[cut].Gap == nil && t.items[cut-1].Gap != nil {
+		// Keep the gap before the batch, which has the same token, so that it can still be filled.
+		cut--
+	}
+	if cut == 0 {
+		return
+	}
+	for _, item := range t.items[:cut] {
+		if item.Event != nil {
+			delete(t.eventIDs, item.Event.ID)
+		}
+	}
+	items := make([]TimelineItem, 0, len(t.items)-cut+1)
+	if t.items[cut].Gap == nil {
+		t.nextGapID++
+		items = append(items, TimelineItem{Gap: &TimelineGap{ID: t.nextGapID, PrevBatch: t.items[cut].prevBatch}})
+	}
+	t.items = append(items, t.items[cut:]...)
+}
+
+// addEvent inserts a copy of the event at the given index, unless it is already in the timeline. Returns false if
+// the event was already there.
+func (t *Timeline) addEvent(index int, event *Event) bool {
+	if event.ID != "" {
+		if t.eventIDs[event.ID] {
+			return false
+		}
+		if t.eventIDs == nil {
+			t.eventIDs = make(map[string]bool)
+		}
+		t.eventIDs[event.ID] = true
+	}
+	ev := *event
+	t.items = append(t.items, TimelineItem{})
+	copy(t.items[index+1:], t.items[index:])
+	t.items[index] = TimelineItem{Event: &ev}
+	return true
+}
+
+// FillGap fills the gap with events from a backwards /messages request starting at the gap's PrevBatch token.
+// chunk is newest first, as returned by /messages, and end is the token to continue paginating from. The gap is
+// removed once the history is complete: when the chunk reaches events already in the timeline or the start of
+// the frame. Otherwise it stays before the new events, with its PrevBatch set to end. Returns the number of
+// events added, ErrNoTimelineGap if the gap is no longer in the timeline, or ErrTimelineGapChanged if its
+// PrevBatch has changed.
+//
+// The timeline isn't trimmed here, as the events added are its oldest and would be dropped straight away. It is
+// trimmed the next time events arrive from /sync.
+func (t *Timeline) FillGap(gap TimelineGap, chunk []Event, end string) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	index := -1
+	for i, item := range t.items {
+		if item.Gap != nil && item.Gap.ID == gap.ID {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return 0, ErrNoTimelineGap
+	}
+	current := t.items[index].Gap
+	if current.PrevBatch != gap.PrevBatch {
+		return 0, ErrTimelineGapChanged
+	}
+	closed := len(chunk) == 0 || end == "" || end == current.PrevBatch
+	added := 0
+	for i := range chunk {
+		// Each older event is inserted straight after the gap, before the newer events.
+		if !t.addEvent(index+1, &chunk[i]) {
+			closed = true
+			break
+		}
+		added++
+	}
+	if added == len(chunk) && added > 0 && end != "" {
+		t.items[index+1].prevBatch = end
+	}
+	if closed {
+		t.items = append(t.items[:index], t.items[index+1:]...)
+	} else {
+		current.PrevBatch = end
+	}
+	return added, nil
+}
+
+// Backfill fetches up to limit events from the most recent gap in the timeline of the frame, using the stored
+// prev_batch token. Returns the number of events added, or ErrNoTimelineGap if there is nothing to fetch.
+func (cli *Client) Backfill(frameID string, limit int) (int, error) {
+	frame := cli.Store.LoadFrame(frameID)
+	if frame == nil {
+		return 0, ErrNoTimelineGap
+	}
+	timeline := frame.Timeline()
+	gap, ok := timeline.LatestGap()
+	if !ok {
+		return 0, ErrNoTimelineGap
+	}
+	resp, err := cli.Messages(frameID, gap.PrevBatch, "", 'b', limit)
+	if err != nil {
+		return 0, err
+	}
+	for i := range resp.Chunk {
+		resp.Chunk[i].FrameID = frameID
+	}
+	return timeline.FillGap(gap, resp.Chunk, resp.End)
+}
@@ -0,0 +1,151 @@
+package xcore
+
+import (
+	"errors"
+	"strings"
+)
+
+// CreateContent is the content of an m.frame.create event.
+type CreateContent struct {
+	Creator      string            `json:"creator,omitempty"` // Removed in frame version 11, where the sender is the creator
+	FrameVersion string            `json:"frame_version,omitempty"`
+	Federate     *bool             `json:"m.federate,omitempty"`
+	Predecessor  *FramePredecessor `json:"predecessor,omitempty"`
+	Type         string            `json:"type,omitempty"`
+}
+
+// FramePredecessor references the frame which was upgraded to create a frame.
+type FramePredecessor struct {
+	FrameID string `json:"frame_id"`
+	EventID string `json:"event_id"` // The ID of the m.frame.tombstone event in the old frame
+}
+
+// TombstoneContent is the content of an m.frame.tombstone event, which marks a frame as replaced.
+type TombstoneContent struct {
+	Body             string `json:"body"`
+	ReplacementFrame string `json:"replacement_frame"`
+}
+
+// Create returns the content of the m.frame.create event, or nil if there is none.
+func (s *FrameState) Create() *CreateContent {
+	event := s.GetStateEvent("m.frame.create", "")
+	if event == nil {
+		return nil
+	}
+	var content CreateContent
+	if err := event.ParseContent(&content); err != nil {
+		return nil
+	}
+	if content.FrameVersion == "" {
+		content.FrameVersion = "1"
+	}
+	return &content
+}
+
+// Tombstone returns the content of the m.frame.tombstone event, or nil if the frame hasn't been replaced.
+func (s *FrameState) Tombstone() *TombstoneContent {
+	event := s.GetStateEvent("m.frame.tombstone", "")
+	if event == nil {
+		return nil
+	}
+	var content TombstoneContent
+	if err := event.ParseContent(&content); err != nil || content.ReplacementFrame == "" {
+		return nil
+	}
+	return &content
+}
+
+// Create returns the content of the frame's m.frame.create event, or nil if it isn't known.
+func (frame *Frame) Create() *CreateContent {
+	return frame.Snapshot().Create()
+}
+
+// Tombstone returns the content of the frame's m.frame.tombstone event, or nil if the frame hasn't been replaced.
+func (frame *Frame) Tombstone() *TombstoneContent {
+	return frame.Snapshot().Tombstone()
+}
+
+// UpgradeFrame upgrades the frame to the given frame version, returning the ID of the replacement frame.
+// See post-coddy-client-r0-frames-frameid-upgrade
+func (cli *Client) UpgradeFrame(frameID, newVersion string) (resp *RespUpgradeFrame, err error) {
+	urlPath := cli.BuildURL("frames", frameID, "upgrade")
+	err = cli.MakeRequest("POST", urlPath, &ReqUpgradeFrame{NewVersion: newVersion}, &resp)
+	return
+}
+
+// FrameUpgradeListener can be used with DefaultSyncer.OnFrameUpgrade to be informed when a joined frame
+// is replaced.
+type FrameUpgradeListener func(frameID string, tombstone *TombstoneContent, event *Event)
+
+// FollowFrameUpgrades makes the client join the replacement frame whenever a frame it is joined to is upgraded.
+// The replacement frame is joined through the server of the user who sent the tombstone. If onJoin is not nil it
+// is called with the result of each join. Requires the client to use a DefaultSyncer.
+func (cli *Client) FollowFrameUpgrades(onJoin func(oldFrameID, newFrameID string, err error)) error {
+	syncer, ok := cli.Syncer.(*DefaultSyncer)
+	if !ok {
+		return errors.New("following frame upgrades requires a DefaultSyncer")
+	}
+	syncer.OnFrameUpgrade(func(frameID string, tombstone *TombstoneContent, event *Event) {
+		_, err := cli.JoinFrame(tombstone.ReplacementFrame, serverName(event.Sender), nil)
+		if onJoin != nil {
+			onJoin(frameID, tombstone.ReplacementFrame, err)
+		}
+	})
+	return nil
+}
+
+// serverName returns the server name part of a user, frame or alias ID, or "" if there is none.
+func serverName(id string) string {
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		return id[i+1:]
+	}
+	return ""
+}
+
+// FrameUpgradeChain returns the IDs of the frames in the upgrade chain of the given frame, from the oldest
+// predecessor to the newest replacement, following the predecessor in m.frame.create events and the replacement
+// in m.frame.tombstone events. Frames referenced by frames in the store are included even if they aren't in the
+// store themselves, but the chain can't be followed any further through them.
+func FrameUpgradeChain(store Storer, frameID string) []string {
+	seen := map[string]bool{frameID: true}
+	var predecessors []string
+	for id := frameID; ; {
+		frame := store.LoadFrame(id)
+		if frame == nil {
+			break
+		}
+		create := frame.Create()
+		if create == nil || create.Predecessor == nil || seen[create.Predecessor.FrameID] {
+			break
+		}
+		id = create.Predecessor.FrameID
+		seen[id] = true
+		predecessors = append(predecessors, id)
+	}
+
+	chain := make([]string, 0, len(predecessors)+1)
+	for i := len(predecessors) - 1; i >= 0; i-- {
+		chain = append(chain, predecessors[i])
+	}
+	chain = append(chain, frameID)
+	for id := frameID; ; {
+		frame := store.LoadFrame(id)
+		if frame == nil {
+			break
+		}
+		tombstone := frame.Tombstone()
+		if tombstone == nil || seen[tombstone.ReplacementFrame] {
+			break
+		}
+		id = tombstone.ReplacementFrame
+		seen[id] = true
+		chain = append(chain, id)
+	}
+	return chain
+}
+
+// LatestFrameID returns the ID of the newest frame in the upgrade chain of the given frame, as known by the store.
+func LatestFrameID(store Storer, frameID string) string {
+	chain := FrameUpgradeChain(store, frameID)
+	return chain[len(chain)-1]
+}
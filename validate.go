@@ -0,0 +1,463 @@
+package xcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxEventSize is the maximum size of an event in bytes, measured as canonical JSON.
+const MaxEventSize = 65536
+
+// Limits on integers which can be represented in canonical JSON.
+const (
+	maxCanonicalInt = 1<<53 - 1
+	minCanonicalInt = -(1<<53 - 1)
+)
+
+// EventValidationError is returned when an event fails client-side validation before being sent.
+type EventValidationError struct {
+	EventType string
+	Field     string // The content field which is invalid, if the error relates to a single field
+	Message   string
+}
+
+func (e EventValidationError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("invalid %s event: %s", e.EventType, e.Message)
+	}
+	return fmt.Sprintf("invalid %s event: %s: %s", e.EventType, e.Field, e.Message)
+}
+
+// EventTooLargeError is returned when an event would be larger than MaxEventSize.
+type EventTooLargeError struct {
+	EventType string
+	Size      int
+}
+
+func (e EventTooLargeError) Error() string {
+	return fmt.Sprintf("%s event is too large: %d bytes, maximum is %d", e.EventType, e.Size, MaxEventSize)
+}
+
+// CanonicalJSON encodes the given value as canonical JSON: keys are sorted, there is no insignificant
+// whitespace and strings only escape the characters which must be escaped.
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	return canonicalJSON(v, false)
+}
+
+// canonicalJSON encodes the given value as canonical JSON. If allowFloats is true, numbers which aren't integers
+// in the canonical range are kept as they are rather than rejected.
+func canonicalJSON(v interface{}, allowFloats bool) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var generic interface{}
+	if err = dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = writeCanonicalJSON(&buf, generic, allowFloats); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, v interface{}, allowFloats bool) error {
+	switch val := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(val))
+	case json.Number:
+		i, err := val.Int64()
+		if err != nil || i > maxCanonicalInt || i < minCanonicalInt {
+			if allowFloats {
+				buf.WriteString(val.String())
+				break
+			}
+			return fmt.Errorf("canonical JSON only allows integers between %d and %d, got %s", minCanonicalInt, maxCanonicalInt, val)
+		}
+		buf.WriteString(strconv.FormatInt(i, 10))
+	case string:
+		writeCanonicalString(buf, val)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, elem := range val {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, elem, allowFloats); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanonicalJSON(buf, val[k], allowFloats); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("cannot encode %T as canonical JSON", v)
+	}
+	return nil
+}
+
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"':
+			buf.WriteString(`\"`)
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r == '\b':
+			buf.WriteString(`\b`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r < 0x20:
+			fmt.Fprintf(buf, `\u%04x`, r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// isValidUserID returns true if the given string has the form of a user ID, e.g "@alice:example.org".
+func isValidUserID(userID string) bool {
+	localpart, err := ExtractUserLocalpart(userID)
+	if err != nil || localpart == "" || len(userID) > 255 {
+		return false
+	}
+	return strings.Contains(userID, ":") && !strings.HasSuffix(userID, ":")
+}
+
+// stateEventTypes are the known event types which must be sent as state events.
+var stateEventTypes = map[string]bool{
+	"m.frame.create":             true,
+	"m.frame.member":             true,
+	"m.frame.power_levels":       true,
+	"m.frame.join_rules":         true,
+	"m.frame.history_visibility": true,
+	"m.frame.guest_access":       true,
+	"m.frame.name":               true,
+	"m.frame.topic":              true,
+	"m.frame.avatar":             true,
+	"m.frame.canonical_alias":    true,
+	"m.frame.pinned_events":      true,
+	"m.frame.server_acl":         true,
+	"m.frame.tombstone":          true,
+	"m.frame.encryption":         true,
+	"m.space.child":              true,
+	"m.space.parent":             true,
+}
+
+// messageEventTypes are the known message event types whose content is validated.
+var messageEventTypes = map[string]bool{
+	"m.frame.message": true,
+	"m.reaction":      true,
+	"m.poll.response": true,
+	"m.poll.end":      true,
+}
+
+// ValidateEvent checks that an event is valid before it is sent, returning an EventValidationError or
+// EventTooLargeError if not. stateKey must be nil for message events.
+//
+// The size of the event is checked against MaxEventSize and the content of known event types (and msgtypes of
+// m.frame.message) is checked for required fields. Member events must have a user ID as their state key. Power
+// levels must be integers in the canonical JSON range, the keys of their users map must be user IDs and the keys
+// of their events map must not be empty. Numbers in the content of known event types must be integers; the content of
+// other event types is not checked, so custom events may contain floats.
+func ValidateEvent(eventType string, stateKey *string, content interface{}) error {
+	return validateEvent(&Event{Type: eventType, StateKey: stateKey}, content)
+}
+
+// validateEvent checks the event, using content in place of the event content. The size is checked against
+// all the fields of the event which are set.
+func validateEvent(event *Event, content interface{}) error {
+	if event.Type == "" {
+		return EventValidationError{Message: "missing event type"}
+	}
+	skeleton := map[string]interface{}{
+		"type":    event.Type,
+		"content": content,
+	}
+	if event.StateKey != nil {
+		skeleton["state_key"] = *event.StateKey
+	}
+	if event.Sender != "" {
+		skeleton["sender"] = event.Sender
+	}
+	if event.FrameID != "" {
+		skeleton["frame_id"] = event.FrameID
+	}
+	// Only the content of known event types is required to be canonical JSON, so custom events may use floats.
+	knownType := stateEventTypes[event.Type] || messageEventTypes[event.Type]
+	canonical, err := canonicalJSON(skeleton, !knownType)
+	if err != nil {
+		return EventValidationError{EventType: event.Type, Field: "content", Message: err.Error()}
+	}
+	if len(canonical) > MaxEventSize {
+		return EventTooLargeError{EventType: event.Type, Size: len(canonical)}
+	}
+
+	var parsed struct {
+		Content map[string]interface{} `json:"content"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(canonical))
+	dec.UseNumber()
+	if err = dec.Decode(&parsed); err != nil || parsed.Content == nil {
+		return EventValidationError{EventType: event.Type, Field: "content", Message: "must be a JSON object"}
+	}
+	v := contentValidator{eventType: event.Type, content: parsed.Content}
+
+	if stateEventTypes[event.Type] && event.StateKey == nil {
+		return v.fail("", "must be sent as a state event")
+	}
+	switch event.Type {
+	case "m.frame.message":
+		return v.message()
+	case "m.frame.member":
+		if !isValidUserID(*event.StateKey) {
+			return v.fail("state_key", "must be a user ID, got "+strconv.Quote(*event.StateKey))
+		}
+		return v.oneOf("membership", "invite", "join", "leave", "ban", "knock")
+	case "m.frame.power_levels":
+		return v.powerLevels()
+	case "m.frame.join_rules":
+		return v.oneOf("join_rule", "public", "knock", "invite", "private", "restricted", "knock_restricted")
+	case "m.frame.history_visibility":
+		return v.oneOf("history_visibility", "invited", "joined", "shared", "world_readable")
+	case "m.frame.guest_access":
+		return v.oneOf("guest_access", "can_join", "forbidden")
+	case "m.frame.name":
+		if err = v.str("name", true); err != nil {
+			return err
+		}
+		if len(v.content["name"].(string)) > 255 {
+			return v.fail("name", "must be at most 255 bytes")
+		}
+	case "m.frame.topic":
+		return v.str("topic", true)
+	case "m.frame.avatar":
+		return v.str("url", false)
+	case "m.frame.canonical_alias":
+		return v.aliases()
+	case "m.frame.create":
+		return v.str("creator", false)
+	case "m.reaction":
+		return v.relation("m.annotation", true)
+	case "m.poll.response", "m.poll.end":
+		return v.relation("m.reference", false)
+	}
+	return nil
+}
+
+// contentValidator checks fields in the content of an event.
+type contentValidator struct {
+	eventType string
+	content   map[string]interface{}
+}
+
+func (v contentValidator) fail(field, msg string) error {
+	return EventValidationError{EventType: v.eventType, Field: field, Message: msg}
+}
+
+// str checks that the field is a string, if present. If required, it must be present.
+func (v contentValidator) str(field string, required bool) error {
+	val, exists := v.content[field]
+	if !exists {
+		if required {
+			return v.fail(field, "missing required field")
+		}
+		return nil
+	}
+	if _, ok := val.(string); !ok {
+		return v.fail(field, "must be a string")
+	}
+	return nil
+}
+
+// oneOf checks that the field is present and is one of the given values.
+func (v contentValidator) oneOf(field string, values ...string) error {
+	if err := v.str(field, true); err != nil {
+		return err
+	}
+	if val := v.content[field].(string); !containsString(values, val) {
+		return v.fail(field, fmt.Sprintf("must be one of %v, got %q", values, val))
+	}
+	return nil
+}
+
+func (v contentValidator) message() error {
+	if err := v.str("msgtype", true); err != nil {
+		return err
+	}
+	if err := v.str("body", true); err != nil {
+		return err
+	}
+	if err := v.str("format", false); err != nil {
+		return err
+	}
+	if err := v.str("formatted_body", false); err != nil {
+		return err
+	}
+	_, hasFormat := v.content["format"]
+	_, hasFormatted := v.content["formatted_body"]
+	if hasFormat != hasFormatted {
+		return v.fail("formatted_body", "format and formatted_body must be given together")
+	}
+	switch v.content["msgtype"].(string) {
+	case "m.image", "m.file", "m.audio", "m.video":
+		// Encrypted media use "file" instead of "url".
+		if _, encrypted := v.content["file"]; encrypted {
+			return nil
+		}
+		if err := v.str("url", true); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(v.content["url"].(string), "mxc://") {
+			return v.fail("url", "must be an mxc:// URI")
+		}
+	case "m.location":
+		if err := v.str("geo_uri", true); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(v.content["geo_uri"].(string), "geo:") {
+			return v.fail("geo_uri", "must be a geo: URI")
+		}
+	}
+	return nil
+}
+
+func (v contentValidator) aliases() error {
+	if err := v.str("alias", false); err != nil {
+		return err
+	}
+	if alias, ok := v.content["alias"].(string); ok && !isValidAlias(alias) {
+		return v.fail("alias", "must be a frame alias")
+	}
+	alt, exists := v.content["alt_aliases"]
+	if !exists {
+		return nil
+	}
+	list, ok := alt.([]interface{})
+	if !ok {
+		return v.fail("alt_aliases", "must be a list of frame aliases")
+	}
+	for _, a := range list {
+		if s, ok := a.(string); !ok || !isValidAlias(s) {
+			return v.fail("alt_aliases", "must be a list of frame aliases")
+		}
+	}
+	return nil
+}
+
+// relation checks the m.relates_to of the content has the given rel_type and an event ID. If needsKey is true,
+// it must also have a key.
+func (v contentValidator) relation(relType string, needsKey bool) error {
+	rel, ok := v.content["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return v.fail("m.relates_to", "missing required relation")
+	}
+	if rt, _ := rel["rel_type"].(string); rt != relType {
+		return v.fail("m.relates_to.rel_type", "must be "+relType)
+	}
+	if id, _ := rel["event_id"].(string); id == "" {
+		return v.fail("m.relates_to.event_id", "missing required field")
+	}
+	if key, _ := rel["key"].(string); needsKey && key == "" {
+		return v.fail("m.relates_to.key", "missing required field")
+	}
+	return nil
+}
+
+// isPowerLevel returns true if the value is an integer in the canonical JSON range, or a string containing one as
+// allowed by older frame versions.
+func isPowerLevel(val interface{}) bool {
+	var level int64
+	var err error
+	switch val := val.(type) {
+	case json.Number:
+		level, err = val.Int64()
+	case string:
+		level, err = strconv.ParseInt(val, 10, 64)
+	default:
+		return false
+	}
+	return err == nil && level >= minCanonicalInt && level <= maxCanonicalInt
+}
+
+// invalidPowerLevel is the validation message for power levels which fail isPowerLevel.
+var invalidPowerLevel = fmt.Sprintf("must be an integer between %d and %d", minCanonicalInt, maxCanonicalInt)
+
+func (v contentValidator) powerLevels() error {
+	for _, field := range []string{"ban", "events_default", "invite", "kick", "redact", "state_default", "users_default"} {
+		if val, exists := v.content[field]; exists && !isPowerLevel(val) {
+			return v.fail(field, invalidPowerLevel)
+		}
+	}
+	for _, field := range []string{"events", "users", "notifications"} {
+		val, exists := v.content[field]
+		if !exists {
+			continue
+		}
+		levels, ok := val.(map[string]interface{})
+		if !ok {
+			return v.fail(field, "must be an object")
+		}
+		for key, level := range levels {
+			if !isPowerLevel(level) {
+				return v.fail(field+"."+key, invalidPowerLevel)
+			}
+			if field == "users" && !isValidUserID(key) {
+				return v.fail(field, strconv.Quote(key)+" is not a user ID")
+			}
+			if field == "events" && key == "" {
+				return v.fail(field, "event types must not be empty")
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateCreateFrame checks the initial state in a ReqCreateFrame with ValidateEvent.
+func ValidateCreateFrame(req *ReqCreateFrame) error {
+	for i := range req.InitialState {
+		event := req.InitialState[i]
+		if event.StateKey == nil {
+			// The state key defaults to the empty string for initial state.
+			empty := ""
+			event.StateKey = &empty
+		}
+		if err := validateEvent(&event, event.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}